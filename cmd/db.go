@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/willgorman/mastodon-bsky/pkg/sync"
+)
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Manage the sync database",
+}
+
+var dbMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Apply the schema migrations the database doesn't have yet",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dataPath, err := requireDataPath()
+		if err != nil {
+			return err
+		}
+		// opening the datastore migrates it
+		data, err := sync.Open(dataPath)
+		if err != nil {
+			return fmt.Errorf("opening database %s: %w", redact(dataPath), err)
+		}
+		data.Close()
+		return printSchemaStatus(cmd, dataPath)
+	},
+}
+
+var dbStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show which schema migrations have been applied",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dataPath, err := requireDataPath()
+		if err != nil {
+			return err
+		}
+		return printSchemaStatus(cmd, dataPath)
+	},
+}
+
+func init() {
+	dbCmd.AddCommand(dbMigrateCmd, dbStatusCmd)
+}
+
+func requireDataPath() (string, error) {
+	dataPath := viper.GetString("data_path")
+	if dataPath == "" {
+		return "", errors.New("missing data_path")
+	}
+	return dataPath, nil
+}
+
+// redact hides the password in a Postgres data_path
+func redact(dataPath string) string {
+	u, err := url.Parse(dataPath)
+	if err != nil || u.User == nil {
+		return dataPath
+	}
+	return u.Redacted()
+}
+
+func printSchemaStatus(cmd *cobra.Command, dataPath string) error {
+	status, err := sync.SchemaStatus(cmd.Context(), dataPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no database at %s, run db migrate to create it", redact(dataPath))
+	}
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, s := range status {
+		applied := "pending"
+		if s.AppliedAt.Valid {
+			applied = s.AppliedAt.Time.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+	}
+	return w.Flush()
+}
@@ -4,13 +4,17 @@ Copyright © 2024 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"errors"
 	"log"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
+var cfgFile string
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "mastodon-bsky",
@@ -31,7 +35,7 @@ to quickly create a Cobra application.`,
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	rootCmd.AddCommand(runCmd)
+	rootCmd.AddCommand(runCmd, dbCmd)
 	err := rootCmd.Execute()
 	if err != nil {
 		os.Exit(1)
@@ -43,12 +47,46 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 
-	// rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.mastodon-bsky.yaml)")
+	cobra.OnInitialize(initConfig)
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is ./mastodon-bsky.yaml or $HOME/.mastodon-bsky.yaml)")
 
 	viper.AutomaticEnv()
 	viper.SetDefault("data_path", "mastodon-bsky.sqlite3")
+	viper.SetDefault("visibility", []string{"public"})
+	viper.SetDefault("restrict_unlisted", false)
+	viper.SetDefault("source", "poll")
+	viper.SetDefault("poll_interval", time.Minute)
+	viper.SetDefault("stream_retry", 5*time.Second)
+	viper.SetDefault("stream_idle", time.Minute)
+	viper.SetDefault("follow_moves", false)
+	viper.SetDefault("lease_ttl", 30*time.Second)
+	viper.SetDefault("lease_wait", false)
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
+
+// initConfig reads in the config file if there is one.  Settings that
+// can't be expressed as environment variables, like filter rules, live here.
+func initConfig() {
+	if cfgFile != "" {
+		viper.SetConfigFile(cfgFile)
+	} else {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			viper.AddConfigPath(home)
+		}
+		viper.AddConfigPath(".")
+		viper.SetConfigName("mastodon-bsky")
+	}
+
+	if err := viper.ReadInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if cfgFile != "" || !errors.As(err, &notFound) {
+			log.Fatalf("reading config: %s", err)
+		}
+		return
+	}
+	log.Println("using config file", viper.ConfigFileUsed())
+}
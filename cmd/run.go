@@ -5,35 +5,332 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"os"
+	"strings"
 	"syscall"
+	"text/template"
+	"time"
 
+	"github.com/sethvargo/go-envconfig"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/vrecan/death/v3"
+	"github.com/willgorman/mastodon-bsky/pkg/bsky"
 	"github.com/willgorman/mastodon-bsky/pkg/mastodon"
 	"github.com/willgorman/mastodon-bsky/pkg/sync"
 )
 
+func init() {
+	runCmd.Flags().String("since", "", "crosspost toots newer than this status ID instead of resuming from the checkpoint")
+}
+
 var runCmd = &cobra.Command{
 	Use: "run",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		log.Println("RUN")
-		dataPath := viper.GetString("data_path")
-		if dataPath == "" {
-			return errors.New("missing data_path")
+		dataPath, err := requireDataPath()
+		if err != nil {
+			return err
 		}
-		log.Println(dataPath)
-		data, err := sync.CreateDatastore(dataPath)
+		log.Println(redact(dataPath))
+		data, err := sync.Open(dataPath)
 		if err != nil {
-			return fmt.Errorf("opening database %s: %w", dataPath, err)
+			return fmt.Errorf("opening database %s: %w", redact(dataPath), err)
 		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 
-		// TODO: (willgorman) create mastodon/bsky source/sink
-		process := sync.New(data, mastodon.NewFakeSource(), nil)
+		visibility, err := sync.ParseVisibilityPolicy(viper.GetStringSlice("visibility"))
+		if err != nil {
+			return err
+		}
+		var filter mastodon.Filter
+		if err := viper.UnmarshalKey("filters", &filter); err != nil {
+			return fmt.Errorf("reading filters: %w", err)
+		}
+		if err := filter.Compile(); err != nil {
+			return err
+		}
+		var directives bsky.Directives
+		if err := viper.UnmarshalKey("directives", &directives); err != nil {
+			return fmt.Errorf("reading directives: %w", err)
+		}
+		directives = directives.WithDefaults()
+		var rewrite bsky.RewriteRules
+		if err := viper.UnmarshalKey("rewrite", &rewrite); err != nil {
+			return fmt.Errorf("reading rewrite rules: %w", err)
+		}
+		if err := rewrite.Compile(); err != nil {
+			return err
+		}
+		var retry sync.RetryPolicy
+		if err := viper.UnmarshalKey("retry", &retry); err != nil {
+			return fmt.Errorf("reading retry policy: %w", err)
+		}
+		var pipeline sync.PipelineConfig
+		if err := viper.UnmarshalKey("pipeline", &pipeline); err != nil {
+			return fmt.Errorf("reading pipeline config: %w", err)
+		}
+		var tmpl *template.Template
+		if text := viper.GetString("template"); text != "" {
+			tmpl, err = bsky.ParseTemplate(text)
+			if err != nil {
+				return err
+			}
+		}
+
+		open, sourceID, err := newSource(ctx, cmd, filter)
+		if err != nil {
+			return err
+		}
+		lease, err := acquireLease(ctx, data, sourceID)
+		if err != nil {
+			return err
+		}
+		// released on the way out if it doesn't get as far as running
+		defer lease.Close()
+		// the checkpoint is only read once the lease is held, in case
+		// another instance had it until now
+		since, err := startAfter(ctx, cmd, data, sourceID)
+		if err != nil {
+			return err
+		}
+		log.Printf("%s %s for toots since %q", viper.GetString("source"), sourceID, since)
+		source := open(since)
+		sink, err := newSink(ctx)
+		if err != nil {
+			return err
+		}
+
+		cfg := sync.Config{
+			Visibility:       visibility,
+			RestrictUnlisted: viper.GetBool("restrict_unlisted"),
+			Filter:           filter,
+			Translation: bsky.TranslatorConfig{
+				Directives: directives,
+				Rewrite:    rewrite,
+				Template:   tmpl,
+				Attribute:  reposts(),
+			},
+			SourceID: sourceID,
+			Retry:    retry,
+			Pipeline: pipeline,
+		}
 
-		// TODO: (willgorman) error logging
-		go process.Run(context.TODO())
 		d := death.NewDeath(syscall.SIGINT, syscall.SIGTERM)
-		return d.WaitForDeath()
+		// TODO: (willgorman) error logging
+		stopped := make(chan error, 1)
+		go func() {
+			for {
+				err := sync.New(data, source, sink, cfg).Run(ctx)
+				source, cfg.SourceID, err = followMove(ctx, data, cfg.SourceID, filter, err)
+				if err != nil {
+					log.Printf("stopped: %s", err)
+					stopped <- err
+					// nothing is crossposted any more, so don't keep the
+					// lease from another instance
+					d.FallOnSword()
+					return
+				}
+			}
+		}()
+		lost := make(chan error, 1)
+		go func() {
+			// held until it's closed, not until ctx is done, so it's kept
+			// while the pipeline finishes.  Another instance could be
+			// posting if it's lost, so stop rather than post anything twice.
+			if err := lease.Hold(context.Background()); err != nil {
+				lost <- err
+				d.FallOnSword()
+			}
+		}()
+		err = d.WaitForDeath()
+		cancel()
+		// the toots being posted are finished with before another instance
+		// can take over
+		if serr := <-stopped; err == nil && !errors.Is(serr, context.Canceled) {
+			err = serr
+		}
+		if rerr := lease.Close(); err == nil {
+			err = rerr
+		}
+		select {
+		case err = <-lost:
+		default:
+		}
+		return err
 	},
 }
+
+// acquireLease takes the lease on crossposting from the source, or stands
+// by until it's free if lease_wait is set.  It stays on the source the run
+// started with if the account moves.
+func acquireLease(ctx context.Context, data sync.Store, sourceID string) (*sync.Lease, error) {
+	host, _ := os.Hostname()
+	holder := fmt.Sprintf("%s:%d:%x", host, os.Getpid(), rand.Uint32())
+	ttl := viper.GetDuration("lease_ttl")
+	if ttl < time.Second {
+		return nil, fmt.Errorf("lease_ttl must be at least 1s, not %s", ttl)
+	}
+	lease := sync.NewLease(data, sourceID, holder, ttl)
+	if viper.GetBool("lease_wait") {
+		if err := lease.Wait(ctx); err != nil {
+			return nil, err
+		}
+		return lease, nil
+	}
+	if err := lease.Acquire(ctx); err != nil {
+		if errors.Is(err, sync.ErrLeaseHeld) {
+			return nil, fmt.Errorf("%w, stop it or set lease_wait to stand by", err)
+		}
+		return nil, err
+	}
+	return lease, nil
+}
+
+type source interface {
+	Open(ctx context.Context) (<-chan mastodon.Status, <-chan error)
+}
+
+// openSource creates a source that starts after the status since
+type openSource func(since string) source
+
+// newSource sets up the configured mastodon source.  It also returns the ID
+// that the checkpoint and lease for the source are stored under.
+func newSource(ctx context.Context, cmd *cobra.Command, filter mastodon.Filter) (openSource, string, error) {
+	kind := viper.GetString("source")
+	switch kind {
+	case "fake":
+		return func(string) source { return mastodon.NewFakeSource() }, "", nil
+	case "outbox":
+		return newOutboxSource(ctx)
+	case "poll", "stream", "hashtag", "list":
+	default:
+		return nil, "", fmt.Errorf("unknown source %q", kind)
+	}
+
+	var cfg mastodon.Config
+	if err := envconfig.Process(ctx, &cfg); err != nil {
+		return nil, "", fmt.Errorf("reading mastodon config: %w", err)
+	}
+	if kind == "hashtag" && viper.GetString("hashtag") == "" {
+		return nil, "", errors.New("missing hashtag for hashtag source")
+	}
+	if kind == "list" && viper.GetString("list_id") == "" {
+		return nil, "", errors.New("missing list_id for list source")
+	}
+	client, err := mastodon.NewClient(ctx, cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	sourceID := client.Account().URL
+	switch kind {
+	case "hashtag":
+		sourceID = strings.TrimSuffix(cfg.Server, "/") + "/tags/" + strings.TrimPrefix(viper.GetString("hashtag"), "#")
+	case "list":
+		sourceID = strings.TrimSuffix(cfg.Server, "/") + "/lists/" + viper.GetString("list_id")
+	}
+	interval := viper.GetDuration("poll_interval")
+	return func(since string) source {
+		switch kind {
+		case "hashtag":
+			return mastodon.NewHashtagSource(*client, viper.GetString("hashtag"), since, interval)
+		case "list":
+			return mastodon.NewListSource(*client, viper.GetString("list_id"), since, interval)
+		}
+		return newAccountSource(client, since, filter)
+	}, sourceID, nil
+}
+
+// newAccountSource polls or streams the statuses of the logged in account
+func newAccountSource(client *mastodon.Client, since string, filter mastodon.Filter) source {
+	if viper.GetString("source") == "stream" {
+		return mastodon.NewStreamSource(*client, since, viper.GetDuration("stream_retry"), viper.GetDuration("stream_idle"), filter)
+	}
+	return mastodon.NewSource(*client, since, viper.GetDuration("poll_interval"), filter)
+}
+
+// followMove handles the error a source stopped with.  When the account
+// has moved and follow_moves is set it logs in to the new account with the
+// MOVED_ mastodon config, e.g. MOVED_MASTODON_SERVER, and carries the
+// checkpoint over to it.  Any other error is returned as is.
+func followMove(ctx context.Context, data sync.Store, from string, filter mastodon.Filter, err error) (source, string, error) {
+	var moved *mastodon.MovedError
+	if !errors.As(err, &moved) {
+		return nil, "", err
+	}
+	log.Printf("ALERT: %s", moved)
+	if !viper.GetBool("follow_moves") {
+		return nil, "", err
+	}
+
+	var cfg mastodon.Config
+	if err := envconfig.ProcessWith(ctx, &envconfig.Config{
+		Target:   &cfg,
+		Lookuper: envconfig.PrefixLookuper("MOVED_", envconfig.OsLookuper()),
+	}); err != nil {
+		return nil, "", fmt.Errorf("reading moved mastodon config: %w", err)
+	}
+	if cfg.Server == "" {
+		return nil, "", fmt.Errorf("%w: set MOVED_MASTODON_SERVER and the other MOVED_ config to follow it", err)
+	}
+	client, err := mastodon.NewClient(ctx, cfg)
+	if err != nil {
+		return nil, "", fmt.Errorf("logging in to moved account: %w", err)
+	}
+	sourceID := client.Account().URL
+	if sourceID != moved.MovedTo.URL {
+		return nil, "", fmt.Errorf("MOVED_ config logs in to %s instead of %s", sourceID, moved.MovedTo.URL)
+	}
+	if err := data.MoveCheckpoint(ctx, from, sourceID); err != nil {
+		return nil, "", err
+	}
+	since, err := data.GetCheckpoint(ctx, sourceID)
+	if err != nil {
+		return nil, "", err
+	}
+	log.Printf("following %s to %s for toots since %q", from, sourceID, since)
+	return newAccountSource(client, since, filter), sourceID, nil
+}
+
+// newOutboxSource reads the public outbox of the account config, which
+// doesn't need mastodon credentials
+func newOutboxSource(ctx context.Context) (openSource, string, error) {
+	account := viper.GetString("account")
+	if account == "" {
+		return nil, "", errors.New("missing account for outbox source")
+	}
+	outbox, err := mastodon.NewOutbox(ctx, nil, account)
+	if err != nil {
+		return nil, "", err
+	}
+	return func(since string) source {
+		return mastodon.NewOutboxSource(outbox, since, viper.GetDuration("poll_interval"))
+	}, outbox.Actor.ID, nil
+}
+
+// startAfter is the status to start after, from the --since flag or the
+// checkpoint for the source
+func startAfter(ctx context.Context, cmd *cobra.Command, data sync.Store, sourceID string) (string, error) {
+	since, _ := cmd.Flags().GetString("since")
+	if since != "" {
+		return since, nil
+	}
+	return data.GetCheckpoint(ctx, sourceID)
+}
+
+// reposts reports whether the source has other people's toots, which
+// get attributed to their author
+func reposts() bool {
+	kind := viper.GetString("source")
+	return kind == "hashtag" || kind == "list"
+}
+
+func newSink(ctx context.Context) (*bsky.Client, error) {
+	var cfg bsky.Config
+	if err := envconfig.Process(ctx, &cfg); err != nil {
+		return nil, fmt.Errorf("reading bluesky config: %w", err)
+	}
+	return bsky.NewClient(cfg)
+}
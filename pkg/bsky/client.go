@@ -1,21 +1,33 @@
 package bsky
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"sync"
 	"time"
 
 	comatproto "github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
 	lexutil "github.com/bluesky-social/indigo/lex/util"
 	"github.com/bluesky-social/indigo/util"
 	"github.com/bluesky-social/indigo/util/cliutil"
 	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/willgorman/mastodon-bsky/pkg/remote"
 )
 
 type Client struct {
 	rpcClient *xrpc.Client
 	session   *comatproto.ServerCreateSession_Output
+
+	mu sync.Mutex
+	// auth has the tokens of the session, which change when it's refreshed
+	auth *xrpc.AuthInfo
 }
 
 type Config struct {
@@ -38,56 +50,309 @@ func NewClient(cfg Config) (*Client, error) {
 		Password:   cfg.Password,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("unable to create session: %w", err)
+		return nil, fmt.Errorf("unable to create session: %w", classify(err))
 	}
 
-	rpc.Auth = &xrpc.AuthInfo{
+	return &Client{
+		rpcClient: rpc,
+		session:   ses,
+		auth: &xrpc.AuthInfo{
+			AccessJwt:  ses.AccessJwt,
+			RefreshJwt: ses.RefreshJwt,
+			Handle:     cfg.Username,
+			Did:        ses.Did,
+		},
+	}, nil
+}
+
+// call makes a request with the session and classifies its error.  If the
+// access token has expired the session is refreshed and the request made
+// again, once.
+func (c *Client) call(ctx context.Context, request func(rpc *xrpc.Client) error) error {
+	rpc := c.rpc()
+	err := classify(request(rpc))
+	var rerr *remote.Error
+	if !errors.As(err, &rerr) || rerr.Kind != remote.AuthExpired {
+		return err
+	}
+	if err := c.refresh(ctx, rpc.Auth); err != nil {
+		return err
+	}
+	return classify(request(c.rpc()))
+}
+
+// rpc is an xrpc client with the current tokens of the session
+func (c *Client) rpc() *xrpc.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rpc := *c.rpcClient
+	rpc.Auth = c.auth
+	return &rpc
+}
+
+// refresh gets new tokens for the session, unless a request that failed at
+// the same time already did
+func (c *Client) refresh(ctx context.Context, expired *xrpc.AuthInfo) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.auth != expired {
+		return nil
+	}
+	// refreshSession is authorized by the refresh token instead
+	rpc := *c.rpcClient
+	rpc.Auth = &xrpc.AuthInfo{AccessJwt: expired.RefreshJwt}
+	ses, err := comatproto.ServerRefreshSession(ctx, &rpc)
+	if err != nil {
+		return fmt.Errorf("unable to refresh session: %w", classify(err))
+	}
+	c.auth = &xrpc.AuthInfo{
 		AccessJwt:  ses.AccessJwt,
 		RefreshJwt: ses.RefreshJwt,
-		Handle:     cfg.Username,
+		Handle:     expired.Handle,
 		Did:        ses.Did,
 	}
+	return nil
+}
 
-	return &Client{
-		rpcClient: rpc,
-		session:   ses,
+// PostResult is a strong ref to a post, with the record key and the web
+// URL for it
+type PostResult struct {
+	Cid  string
+	Uri  string
+	Rkey string
+	// URL is the post on bsky.app
+	URL string
+}
+
+// result is the PostResult for a post of the client's account.  If the uri
+// can't be parsed the result only has the Uri and Cid, with the error.
+func (c *Client) result(uri, cid string) (*PostResult, error) {
+	aturi, err := syntax.ParseATURI(uri)
+	if err != nil {
+		return &PostResult{Cid: cid, Uri: uri}, fmt.Errorf("parsing post uri %s: %w", uri, err)
+	}
+	rkey := aturi.RecordKey().String()
+	return &PostResult{
+		Cid:  cid,
+		Uri:  uri,
+		Rkey: rkey,
+		URL:  PostURL(c.session.Handle, rkey),
 	}, nil
 }
 
-type PostResult struct {
-	Cid string
-	Uri string
+// PostURL is the bsky.app URL of the post with the rkey by the actor, a
+// handle or a DID
+func PostURL(actor, rkey string) string {
+	return "https://bsky.app/profile/" + actor + "/post/" + rkey
 }
 
+// Post writes the post to the PDS.  If the post was made but something after
+// it failed, like the threadgate, the result is returned with the error.
 func (c *Client) Post(ctx context.Context, post Post) (*PostResult, error) {
 	if post.CreatedAt == "" {
 		post.CreatedAt = time.Now().UTC().Format(util.ISO8601)
 	}
 
+	if post.Rkey != "" {
+		existing, err := c.existingPost(ctx, post)
+		if err != nil {
+			return existing, err
+		}
+		if existing != nil {
+			// posted before but we didn't hear about it, the threadgate
+			// might not have been made
+			if post.RestrictReplies {
+				if err := c.restrictReplies(ctx, existing.Uri); err != nil {
+					return existing, err
+				}
+			}
+			return existing, nil
+		}
+	}
+
 	// TODO: (willgorman) handle image upload?
-	for image, data := range post.images {
-		response, err := comatproto.RepoUploadBlob(ctx, c.rpcClient, data)
+	for image, body := range post.images {
+		// read it all first so the upload can be made again
+		data, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrFetchMedia, err)
+		}
+		var response *comatproto.RepoUploadBlob_Output
+		err = c.call(ctx, func(rpc *xrpc.Client) (err error) {
+			response, err = comatproto.RepoUploadBlob(ctx, rpc, bytes.NewReader(data))
+			return err
+		})
 		if err != nil {
-			return nil, fmt.Errorf("failed to upload blob: %w", err)
+			return nil, fmt.Errorf("%w: %w", ErrUploadBlob, err)
 		}
 		image.Image = response.Blob
 	}
 
-	resp, err := comatproto.RepoCreateRecord(ctx, c.rpcClient, &comatproto.RepoCreateRecord_Input{
-		Collection: "app.bsky.feed.post",
-		Repo:       c.rpcClient.Auth.Did,
-		Record:     &lexutil.LexiconTypeDecoder{Val: &post.FeedPost},
+	var result *PostResult
+	if post.Rkey != "" {
+		var resp *comatproto.RepoPutRecord_Output
+		err := c.call(ctx, func(rpc *xrpc.Client) (err error) {
+			resp, err = comatproto.RepoPutRecord(ctx, rpc, &comatproto.RepoPutRecord_Input{
+				Collection: postCollection,
+				Repo:       c.session.Did,
+				Rkey:       post.Rkey,
+				Record:     &lexutil.LexiconTypeDecoder{Val: post.record()},
+			})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to post: %w", err)
+		}
+		if result, err = c.result(resp.Uri, resp.Cid); err != nil {
+			return result, err
+		}
+	} else {
+		var resp *comatproto.RepoCreateRecord_Output
+		err := c.call(ctx, func(rpc *xrpc.Client) (err error) {
+			resp, err = comatproto.RepoCreateRecord(ctx, rpc, &comatproto.RepoCreateRecord_Input{
+				Collection: postCollection,
+				Repo:       c.session.Did,
+				Record:     &lexutil.LexiconTypeDecoder{Val: post.record()},
+			})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to post: %w", err)
+		}
+		if result, err = c.result(resp.Uri, resp.Cid); err != nil {
+			return result, err
+		}
+	}
+	if post.RestrictReplies {
+		if err := c.restrictReplies(ctx, result.Uri); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+const postCollection = "app.bsky.feed.post"
+
+// sourcedPost is a post record with the URL of the toot it's of.  Records
+// can have fields their lexicon doesn't, bluesky keeps them as they are.
+type sourcedPost struct {
+	bsky.FeedPost
+	SourceURL string `json:"sourceUrl,omitempty" cborgen:"sourceUrl,omitempty"`
+}
+
+// record is the record the post is written as
+func (p Post) record() *sourcedPost {
+	return &sourcedPost{FeedPost: p.FeedPost, SourceURL: p.SourceURL}
+}
+
+// isOf reports whether the record is of the post.  Posts of the same toot
+// made at the same time are, even if the template or rewrite rules have
+// changed since.  Posts without a source URL have to have the same text.
+func (r sourcedPost) isOf(post Post) bool {
+	if r.CreatedAt != post.CreatedAt {
+		return false
+	}
+	if r.SourceURL != "" && post.SourceURL != "" {
+		return r.SourceURL == post.SourceURL
+	}
+	return r.Text == post.Text
+}
+
+// RecordKey is the rkey for a post of the status with the ID, created at
+// the time.  It's a TID, so the posts sort by the second the statuses were
+// made, and the same status always gets the same key.  Some servers only
+// give times to the second, so the microseconds come from the ID to tell
+// apart statuses from the same second.  clockID tells apart sources and
+// has to be less than 1024.
+func RecordKey(createdAt time.Time, id string, clockID uint) string {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	micros := time.Duration(h.Sum64()%uint64(time.Second/time.Microsecond)) * time.Microsecond
+	return syntax.NewTIDFromTime(createdAt.Truncate(time.Second).Add(micros), clockID).String()
+}
+
+// ErrRkeyTaken is returned when a post's Rkey is already used by a
+// different post
+var ErrRkeyTaken = errors.New("record key is used by another post")
+
+// existingPost gets the post that was already written with the Rkey of
+// post, or nil if there isn't one
+func (c *Client) existingPost(ctx context.Context, post Post) (*PostResult, error) {
+	// not comatproto.RepoGetRecord, which decodes the value as a FeedPost
+	// and drops the source URL
+	var resp struct {
+		Uri   string          `json:"uri"`
+		Cid   *string         `json:"cid"`
+		Value json.RawMessage `json:"value"`
+	}
+	err := c.call(ctx, func(rpc *xrpc.Client) error {
+		return rpc.Do(ctx, xrpc.Query, "", "com.atproto.repo.getRecord", map[string]interface{}{
+			"collection": postCollection,
+			"repo":       c.session.Did,
+			"rkey":       post.Rkey,
+		}, nil, &resp)
 	})
+	var rerr *remote.Error
+	if errors.As(err, &rerr) && rerr.Kind == remote.NotFound {
+		return nil, nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to post: %w", err)
+		return nil, fmt.Errorf("failed to get post %s: %w", post.Rkey, err)
+	}
+	// a different toot could have got the same key, so check it's the same
+	// post
+	var existing sourcedPost
+	if err := json.Unmarshal(resp.Value, &existing); err != nil || !existing.isOf(post) {
+		return nil, &remote.Error{Service: service, Kind: remote.InvalidRequest, Err: fmt.Errorf("%w: %s", ErrRkeyTaken, resp.Uri)}
+	}
+	cid := ""
+	if resp.Cid != nil {
+		cid = *resp.Cid
 	}
-	return &PostResult{Cid: resp.Cid, Uri: resp.Uri}, nil
+	return c.result(resp.Uri, cid)
+}
+
+// restrictReplies creates a threadgate for the post that only allows replies
+// from mentioned users.  An empty allow list would mean nobody can reply but
+// the generated type drops it with omitempty, and crossposted toots don't
+// carry bluesky mention facets so this amounts to the same thing.
+// A threadgate has to use the same rkey as the post it applies to.
+func (c *Client) restrictReplies(ctx context.Context, postUri string) error {
+	uri, err := syntax.ParseATURI(postUri)
+	if err != nil {
+		return fmt.Errorf("parsing post uri %s: %w", postUri, err)
+	}
+	// putRecord so that making it again for a retried post replaces it
+	err = c.call(ctx, func(rpc *xrpc.Client) error {
+		_, err := comatproto.RepoPutRecord(ctx, rpc, &comatproto.RepoPutRecord_Input{
+			Collection: "app.bsky.feed.threadgate",
+			Repo:       c.session.Did,
+			Rkey:       uri.RecordKey().String(),
+			Record: &lexutil.LexiconTypeDecoder{Val: &bsky.FeedThreadgate{
+				Allow: []*bsky.FeedThreadgate_Allow_Elem{
+					{FeedThreadgate_MentionRule: &bsky.FeedThreadgate_MentionRule{}},
+				},
+				CreatedAt: time.Now().UTC().Format(util.ISO8601),
+				Post:      postUri,
+			}},
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create threadgate: %w", err)
+	}
+	return nil
 }
 
 func (c *Client) ListRecords(ctx context.Context, repoName string) ([]*bsky.FeedPost, error) {
 	// TODO: (willgorman) return a channel of FeedPost backed by consuming the feed in pages
-	out, err := comatproto.RepoListRecords(context.Background(),
-		c.rpcClient, "app.bsky.feed.post", "", 1, repoName, true, "", "")
+	var out *comatproto.RepoListRecords_Output
+	err := c.call(ctx, func(rpc *xrpc.Client) (err error) {
+		out, err = comatproto.RepoListRecords(context.Background(),
+			rpc, postCollection, "", 1, repoName, true, "", "")
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("listing records: %w", err)
 	}
@@ -2,12 +2,21 @@ package bsky_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
 	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/sethvargo/go-envconfig"
 	"github.com/willgorman/mastodon-bsky/pkg/bsky"
+	"github.com/willgorman/mastodon-bsky/pkg/remote"
 	"gotest.tools/assert"
 )
 
@@ -48,3 +57,180 @@ func TestList(t *testing.T) {
 	t.Skip("not done")
 	// litter.Dump(c.ListRecords(context.Background()))
 }
+
+// recordingPDS keeps the posts written to it by rkey
+type recordingPDS struct {
+	*httptest.Server
+	mu      sync.Mutex
+	records map[string]json.RawMessage
+	puts    int
+	// failThreadgates makes putting a threadgate fail
+	failThreadgates bool
+}
+
+func newRecordingPDS(t *testing.T) *recordingPDS {
+	pds := &recordingPDS{records: map[string]json.RawMessage{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/xrpc/com.atproto.server.createSession", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"accessJwt": "access", "refreshJwt": "refresh", "did": "did:plc:test", "handle": "test.bsky.social"})
+	})
+	mux.HandleFunc("/xrpc/com.atproto.repo.getRecord", func(w http.ResponseWriter, r *http.Request) {
+		pds.mu.Lock()
+		defer pds.mu.Unlock()
+		q := r.URL.Query()
+		record, ok := pds.records[q.Get("collection")+"/"+q.Get("rkey")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "RecordNotFound", "message": "Could not locate record"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"uri":   "at://did:plc:test/" + q.Get("collection") + "/" + q.Get("rkey"),
+			"cid":   "cid-" + q.Get("rkey"),
+			"value": record,
+		})
+	})
+	mux.HandleFunc("/xrpc/com.atproto.repo.putRecord", func(w http.ResponseWriter, r *http.Request) {
+		pds.mu.Lock()
+		defer pds.mu.Unlock()
+		var in struct {
+			Collection string          `json:"collection"`
+			Rkey       string          `json:"rkey"`
+			Record     json.RawMessage `json:"record"`
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		if pds.failThreadgates && in.Collection == "app.bsky.feed.threadgate" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "InvalidRecord", "message": "Invalid threadgate"})
+			return
+		}
+		pds.records[in.Collection+"/"+in.Rkey] = in.Record
+		pds.puts++
+		json.NewEncoder(w).Encode(map[string]string{
+			"uri": "at://did:plc:test/" + in.Collection + "/" + in.Rkey,
+			"cid": "cid-" + in.Rkey,
+		})
+	})
+	pds.Server = httptest.NewServer(mux)
+	t.Cleanup(pds.Close)
+	return pds
+}
+
+func TestPostWithRkey(t *testing.T) {
+	pds := newRecordingPDS(t)
+	c, err := bsky.NewClient(bsky.Config{PDSUrl: pds.URL, Username: "test.bsky.social", Password: "password"})
+	assert.NilError(t, err)
+
+	createdAt := time.Date(2024, 1, 20, 15, 4, 5, 0, time.UTC)
+	post := bsky.Post{
+		FeedPost:        appbsky.FeedPost{Text: "hello", CreatedAt: createdAt.Format(time.RFC3339)},
+		RestrictReplies: true,
+		Rkey:            bsky.RecordKey(createdAt, "1", 7),
+	}
+	first, err := c.Post(context.Background(), post)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, first, &bsky.PostResult{
+		Cid:  "cid-" + post.Rkey,
+		Uri:  "at://did:plc:test/app.bsky.feed.post/" + post.Rkey,
+		Rkey: post.Rkey,
+		URL:  "https://bsky.app/profile/test.bsky.social/post/" + post.Rkey,
+	})
+
+	// posting it again finds the first post instead of making another
+	again, err := c.Post(context.Background(), post)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, again, first)
+	pds.mu.Lock()
+	assert.Equal(t, len(pds.records), 2) // the post and its threadgate
+	pds.mu.Unlock()
+
+	// a different post can't take over the key
+	other := post
+	other.Text = "goodbye"
+	_, err = c.Post(context.Background(), other)
+	assert.Assert(t, errors.Is(err, bsky.ErrRkeyTaken), "got %v", err)
+	var berr *remote.Error
+	assert.Assert(t, errors.As(err, &berr))
+	assert.Assert(t, !berr.Transient())
+}
+
+func TestPostWithSourceURL(t *testing.T) {
+	pds := newRecordingPDS(t)
+	c, err := bsky.NewClient(bsky.Config{PDSUrl: pds.URL, Username: "test.bsky.social", Password: "password"})
+	assert.NilError(t, err)
+
+	createdAt := time.Date(2024, 1, 20, 15, 4, 5, 0, time.UTC)
+	post := bsky.Post{
+		FeedPost:  appbsky.FeedPost{Text: "hello", CreatedAt: createdAt.Format(time.RFC3339)},
+		Rkey:      bsky.RecordKey(createdAt, "1", 7),
+		SourceURL: "https://example.com/users/me/statuses/1",
+	}
+	first, err := c.Post(context.Background(), post)
+	assert.NilError(t, err)
+	pds.mu.Lock()
+	assert.Assert(t, strings.Contains(string(pds.records["app.bsky.feed.post/"+post.Rkey]), `"sourceUrl":"https://example.com/users/me/statuses/1"`))
+	pds.mu.Unlock()
+
+	// the template changing before a retry doesn't stop it finding the post
+	retried := post
+	retried.Text = "hello\n\n🐘 original"
+	again, err := c.Post(context.Background(), retried)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, again, first)
+
+	// but a different toot can't take over the key
+	other := post
+	other.SourceURL = "https://example.com/users/me/statuses/2"
+	_, err = c.Post(context.Background(), other)
+	assert.Assert(t, errors.Is(err, bsky.ErrRkeyTaken), "got %v", err)
+	pds.mu.Lock()
+	assert.Equal(t, pds.puts, 1)
+	pds.mu.Unlock()
+}
+
+func TestPostThreadgateFails(t *testing.T) {
+	pds := newRecordingPDS(t)
+	pds.failThreadgates = true
+	c, err := bsky.NewClient(bsky.Config{PDSUrl: pds.URL, Username: "test.bsky.social", Password: "password"})
+	assert.NilError(t, err)
+
+	createdAt := time.Date(2024, 1, 20, 15, 4, 5, 0, time.UTC)
+	post := bsky.Post{
+		FeedPost:        appbsky.FeedPost{Text: "hello", CreatedAt: createdAt.Format(time.RFC3339)},
+		RestrictReplies: true,
+		Rkey:            bsky.RecordKey(createdAt, "1", 7),
+	}
+	// the post was made, so it's returned with the error
+	result, err := c.Post(context.Background(), post)
+	assert.ErrorContains(t, err, "failed to create threadgate")
+	assert.Assert(t, result != nil)
+	assert.Equal(t, result.Rkey, post.Rkey)
+
+	// posting again finishes it
+	pds.mu.Lock()
+	pds.failThreadgates = false
+	pds.mu.Unlock()
+	again, err := c.Post(context.Background(), post)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, again, result)
+	pds.mu.Lock()
+	assert.Equal(t, len(pds.records), 2)
+	pds.mu.Unlock()
+}
+
+func TestRecordKey(t *testing.T) {
+	createdAt := time.Date(2024, 1, 20, 15, 4, 5, 123000000, time.UTC)
+	key := bsky.RecordKey(createdAt, "1", 7)
+	assert.Equal(t, key, bsky.RecordKey(createdAt, "1", 7))
+	assert.Assert(t, key != bsky.RecordKey(createdAt, "1", 8))
+	// statuses from the same second, like from an outbox which only has
+	// seconds, get different keys
+	assert.Assert(t, key != bsky.RecordKey(createdAt.Truncate(time.Second), "2", 7))
+	assert.Equal(t, key, bsky.RecordKey(createdAt.Truncate(time.Second), "1", 7))
+	assert.Assert(t, key < bsky.RecordKey(createdAt.Add(time.Second), "0", 7), "keys sort by time")
+
+	tid, err := syntax.ParseTID(key)
+	assert.NilError(t, err)
+	assert.Assert(t, tid.Time().Truncate(time.Second).Equal(createdAt.Truncate(time.Second)))
+	assert.Equal(t, tid.ClockID(), uint(7))
+}
@@ -0,0 +1,162 @@
+package bsky
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	comatproto "github.com/bluesky-social/indigo/api/atproto"
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+)
+
+// Directives are hashtags in the text of a toot that control how it gets
+// crossposted.  They're removed from the text of the bluesky post.
+type Directives struct {
+	// OptOut tags skip crossposting a toot
+	OptOut []string `mapstructure:"opt_out"`
+	// OptIn tags are required for a toot to be crossposted when
+	// RequireOptIn is set
+	OptIn        []string `mapstructure:"opt_in"`
+	RequireOptIn bool     `mapstructure:"require_opt_in"`
+	// Labels maps tags to the self label they add to the post
+	Labels map[string]string `mapstructure:"labels"`
+}
+
+var DefaultDirectives = Directives{
+	OptOut: []string{"nobsky"},
+	OptIn:  []string{"bsky"},
+	Labels: map[string]string{
+		"bsky-cw":   "graphic-media",
+		"bsky-nsfw": "sexual",
+	},
+}
+
+// WithDefaults fills in what isn't set from DefaultDirectives.  Lists and
+// labels that are set to nothing stay that way, so the defaults can be
+// turned off.
+func (d Directives) WithDefaults() Directives {
+	if d.OptOut == nil {
+		d.OptOut = append([]string(nil), DefaultDirectives.OptOut...)
+	}
+	if d.OptIn == nil {
+		d.OptIn = append([]string(nil), DefaultDirectives.OptIn...)
+	}
+	if d.Labels == nil {
+		d.Labels = make(map[string]string, len(DefaultDirectives.Labels))
+		for tag, label := range DefaultDirectives.Labels {
+			d.Labels[tag] = label
+		}
+	}
+	return d
+}
+
+// mastodon doesn't allow - in hashtags but we do so that #bsky-cw is one
+// directive and not #bsky followed by -cw
+var hashtagRegex = regexp.MustCompile(`#[\p{L}\p{N}_-]+`)
+
+// Skip returns the reason a toot with the given text should not be
+// crossposted, or false if the directives allow it.
+func (d Directives) Skip(text string) (string, bool) {
+	found := d.find(text)
+	for _, tag := range d.OptOut {
+		if found[strings.ToLower(tag)] {
+			return fmt.Sprintf("opted out with #%s", tag), true
+		}
+	}
+	if !d.RequireOptIn {
+		return "", false
+	}
+	for _, tag := range d.OptIn {
+		if found[strings.ToLower(tag)] {
+			return "", false
+		}
+	}
+	return "not opted in", true
+}
+
+// SelfLabels returns the labels added by directives in the text
+func (d Directives) SelfLabels(text string) *appbsky.FeedPost_Labels {
+	found := d.find(text)
+	var values []string
+	for tag, label := range d.Labels {
+		if found[strings.ToLower(tag)] {
+			values = append(values, label)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	sort.Strings(values)
+	labels := &comatproto.LabelDefs_SelfLabels{}
+	for i, v := range values {
+		if i > 0 && values[i-1] == v {
+			continue
+		}
+		labels.Values = append(labels.Values, &comatproto.LabelDefs_SelfLabel{Val: v})
+	}
+	return &appbsky.FeedPost_Labels{LabelDefs_SelfLabels: labels}
+}
+
+// Strip removes directives from the text along with the spaces in front
+// of them, or after them when they start a line.
+func (d Directives) Strip(text string) string {
+	var buf strings.Builder
+	last := 0
+	for _, loc := range d.directiveIndex(text) {
+		buf.WriteString(strings.TrimRight(text[last:loc[0]], " \t"))
+		last = loc[1]
+		if buf.Len() == 0 || strings.HasSuffix(buf.String(), "\n") {
+			for last < len(text) && (text[last] == ' ' || text[last] == '\t') {
+				last++
+			}
+		}
+	}
+	if last == 0 {
+		return text
+	}
+	buf.WriteString(text[last:])
+	return strings.TrimSpace(buf.String())
+}
+
+func (d Directives) find(text string) map[string]bool {
+	found := map[string]bool{}
+	for _, loc := range d.directiveIndex(text) {
+		found[strings.ToLower(text[loc[0]+1:loc[1]])] = true
+	}
+	return found
+}
+
+func (d Directives) directiveIndex(text string) [][]int {
+	var locs [][]int
+	for _, loc := range hashtagRegex.FindAllStringIndex(text, -1) {
+		if loc[0] > 0 {
+			r, _ := utf8.DecodeLastRuneInString(text[:loc[0]])
+			if !unicode.IsSpace(r) {
+				continue
+			}
+		}
+		if d.isDirective(text[loc[0]+1 : loc[1]]) {
+			locs = append(locs, loc)
+		}
+	}
+	return locs
+}
+
+func (d Directives) isDirective(tag string) bool {
+	for _, list := range [][]string{d.OptOut, d.OptIn} {
+		for _, t := range list {
+			if strings.EqualFold(t, tag) {
+				return true
+			}
+		}
+	}
+	for t := range d.Labels {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
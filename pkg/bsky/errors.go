@@ -0,0 +1,44 @@
+package bsky
+
+import (
+	"errors"
+
+	"github.com/bluesky-social/indigo/xrpc"
+	"github.com/willgorman/mastodon-bsky/pkg/remote"
+)
+
+// ErrFetchMedia wraps errors getting the images of a toot from its server
+var ErrFetchMedia = errors.New("failed to fetch media")
+
+// ErrUploadBlob wraps errors uploading images to the PDS
+var ErrUploadBlob = errors.New("failed to upload blob")
+
+// service is the remote.Error Service of errors from the PDS
+const service = "bluesky"
+
+// classify turns xrpc and network errors into a remote.Error.  Anything else
+// is returned as is.
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+	var xerr *xrpc.Error
+	if errors.As(err, &xerr) {
+		e := &remote.Error{Service: service, Kind: remote.KindForStatus(xerr.StatusCode), StatusCode: xerr.StatusCode, Err: err}
+		var xrpcErr *xrpc.XRPCError
+		if errors.As(err, &xrpcErr) {
+			switch xrpcErr.ErrStr {
+			case "ExpiredToken", "InvalidToken":
+				e.Kind = remote.AuthExpired
+			case "RecordNotFound":
+				// getRecord answers 400 for a record that isn't there
+				e.Kind = remote.NotFound
+			}
+		}
+		if e.Kind == remote.RateLimited && xerr.Ratelimit != nil {
+			e.RetryAfter = xerr.Ratelimit.Reset
+		}
+		return e
+	}
+	return remote.NetworkError(service, err)
+}
@@ -0,0 +1,203 @@
+package bsky_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	appbsky "github.com/bluesky-social/indigo/api/bsky"
+	"github.com/willgorman/mastodon-bsky/pkg/bsky"
+	"github.com/willgorman/mastodon-bsky/pkg/remote"
+	"gotest.tools/assert"
+)
+
+// fakePDS creates and refreshes sessions and answers createRecord with the
+// status, error and headers it's given
+func fakePDS(t *testing.T, status int, errStr string, header http.Header) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/xrpc/com.atproto.server.createSession", "/xrpc/com.atproto.server.refreshSession":
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"accessJwt":  "access",
+				"refreshJwt": "refresh",
+				"did":        "did:plc:test",
+				"handle":     "test.bsky.social",
+			})
+		case "/xrpc/com.atproto.repo.createRecord":
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(status)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": errStr, "message": "from the test"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPostErrors(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Truncate(time.Second)
+	tests := []struct {
+		name      string
+		status    int
+		errStr    string
+		header    http.Header
+		kind      remote.Kind
+		transient bool
+		retry     time.Time
+	}{
+		{name: "unauthorized", status: http.StatusUnauthorized, errStr: "AuthRequired", kind: remote.AuthExpired},
+		{name: "expired token", status: http.StatusBadRequest, errStr: "ExpiredToken", kind: remote.AuthExpired},
+		{
+			name:   "rate limited",
+			status: http.StatusTooManyRequests,
+			errStr: "RateLimitExceeded",
+			header: http.Header{
+				"Ratelimit-Limit":     {"5000"},
+				"Ratelimit-Remaining": {"0"},
+				"Ratelimit-Reset":     {strconv.FormatInt(reset.Unix(), 10)},
+			},
+			kind:      remote.RateLimited,
+			transient: true,
+			retry:     reset,
+		},
+		{name: "invalid record", status: http.StatusBadRequest, errStr: "InvalidRequest", kind: remote.InvalidRequest},
+		{name: "not found", status: http.StatusNotFound, errStr: "RepoNotFound", kind: remote.NotFound},
+		{name: "upstream", status: http.StatusBadGateway, errStr: "UpstreamFailure", kind: remote.Upstream, transient: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := fakePDS(t, tt.status, tt.errStr, tt.header)
+			c, err := bsky.NewClient(bsky.Config{PDSUrl: srv.URL, Username: "test.bsky.social", Password: "password"})
+			assert.NilError(t, err)
+
+			_, err = c.Post(context.Background(), bsky.Post{FeedPost: appbsky.FeedPost{Text: "hello"}})
+			var berr *remote.Error
+			assert.Assert(t, errors.As(err, &berr), "got %v", err)
+			assert.Equal(t, berr.Kind, tt.kind)
+			assert.Equal(t, berr.StatusCode, tt.status)
+			assert.Equal(t, berr.Transient(), tt.transient)
+			assert.Assert(t, berr.RetryAfter.Equal(tt.retry), "got %s", berr.RetryAfter)
+		})
+	}
+}
+
+func TestNetworkError(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	_, err := bsky.NewClient(bsky.Config{PDSUrl: srv.URL, Username: "test.bsky.social", Password: "password"})
+	var berr *remote.Error
+	assert.Assert(t, errors.As(err, &berr), "got %v", err)
+	assert.Equal(t, berr.Kind, remote.Network)
+	assert.Equal(t, berr.Service, "bluesky")
+	assert.Equal(t, berr.StatusCode, 0)
+	assert.Assert(t, berr.Transient())
+}
+
+// expiringPDS only takes the last access token it gave out for
+// createRecord, until expire is called
+type expiringPDS struct {
+	*httptest.Server
+	mu        sync.Mutex
+	access    string
+	refreshes int
+	// refreshFails makes refreshSession say the refresh token has expired
+	refreshFails bool
+}
+
+func newExpiringPDS(t *testing.T) *expiringPDS {
+	pds := &expiringPDS{access: "access-0"}
+	pds.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pds.mu.Lock()
+		defer pds.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		auth := r.Header.Get("Authorization")
+		switch r.URL.Path {
+		case "/xrpc/com.atproto.server.createSession":
+		case "/xrpc/com.atproto.server.refreshSession":
+			if pds.refreshFails || auth != "Bearer refresh" {
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": "ExpiredToken", "message": "Token has expired"})
+				return
+			}
+			pds.refreshes++
+			pds.access = "access-" + strconv.Itoa(pds.refreshes)
+		case "/xrpc/com.atproto.repo.createRecord":
+			if auth != "Bearer "+pds.access {
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": "ExpiredToken", "message": "Token has expired"})
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"uri": "at://did:plc:test/app.bsky.feed.post/3kj2tj5zmqc2x",
+				"cid": "bafyreicid",
+			})
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"accessJwt":  pds.access,
+			"refreshJwt": "refresh",
+			"did":        "did:plc:test",
+			"handle":     "test.bsky.social",
+		})
+	}))
+	t.Cleanup(pds.Close)
+	return pds
+}
+
+func (pds *expiringPDS) refreshed() int {
+	pds.mu.Lock()
+	defer pds.mu.Unlock()
+	return pds.refreshes
+}
+
+// expire makes the access token given out stop working
+func (pds *expiringPDS) expire() {
+	pds.mu.Lock()
+	defer pds.mu.Unlock()
+	pds.access = "expired"
+}
+
+func TestRefreshSession(t *testing.T) {
+	pds := newExpiringPDS(t)
+	c, err := bsky.NewClient(bsky.Config{PDSUrl: pds.URL, Username: "test.bsky.social", Password: "password"})
+	assert.NilError(t, err)
+
+	_, err = c.Post(context.Background(), bsky.Post{FeedPost: appbsky.FeedPost{Text: "hello"}})
+	assert.NilError(t, err)
+	assert.Equal(t, pds.refreshed(), 0)
+
+	pds.expire()
+	// refreshSession gives out a new access token and the post is made
+	// again with it
+	_, err = c.Post(context.Background(), bsky.Post{FeedPost: appbsky.FeedPost{Text: "hello"}})
+	assert.NilError(t, err)
+	assert.Equal(t, pds.refreshed(), 1)
+	_, err = c.Post(context.Background(), bsky.Post{FeedPost: appbsky.FeedPost{Text: "hello"}})
+	assert.NilError(t, err)
+	assert.Equal(t, pds.refreshed(), 1)
+
+	pds.expire()
+	pds.mu.Lock()
+	pds.refreshFails = true
+	pds.mu.Unlock()
+	_, err = c.Post(context.Background(), bsky.Post{FeedPost: appbsky.FeedPost{Text: "hello"}})
+	var berr *remote.Error
+	assert.Assert(t, errors.As(err, &berr), "got %v", err)
+	assert.Equal(t, berr.Kind, remote.AuthExpired)
+	assert.Assert(t, !berr.Transient())
+}
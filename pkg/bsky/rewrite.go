@@ -0,0 +1,168 @@
+package bsky
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"mvdan.cc/xurls/v2"
+)
+
+// RewriteRule changes the text of a toot before it's posted.  A rule can
+// do any combination of the rewrites it has fields for, e.g.
+//
+//	rewrite:
+//	  - pattern: '\bTwitter\b'
+//	    replace: X
+//	  - strip_params: ["utm_*", fbclid]
+//	  - profiles:
+//	      alice@mastodon.social: alice.bsky.social
+//	    hashtags: [mastodon.social]
+type RewriteRule struct {
+	// Pattern is a regular expression replaced with Replace, which can
+	// refer to submatches like regexp.Regexp.ReplaceAllString
+	Pattern string `mapstructure:"pattern"`
+	Replace string `mapstructure:"replace"`
+	// StripParams are patterns for query parameters to remove from urls
+	StripParams []string `mapstructure:"strip_params"`
+	// Profiles maps mastodon accounts to the bluesky handles their profile
+	// urls are rewritten to, and mentions of them are linked to
+	Profiles map[string]string `mapstructure:"profiles"`
+	// Hashtags are mastodon servers whose hashtag urls are rewritten to
+	// bluesky hashtag urls, and hashtags that link to them are linked to
+	Hashtags []string `mapstructure:"hashtags"`
+
+	re *regexp.Regexp
+}
+
+type RewriteRules []RewriteRule
+
+var strictURLs = xurls.Strict()
+
+// Compile checks the rules and compiles their regular expressions.
+func (r RewriteRules) Compile() error {
+	for i := range r {
+		for _, param := range r[i].StripParams {
+			if _, err := path.Match(param, ""); err != nil {
+				return fmt.Errorf("invalid strip_params pattern %q: %w", param, err)
+			}
+		}
+		if r[i].Pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(r[i].Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid rewrite pattern %q: %w", r[i].Pattern, err)
+		}
+		r[i].re = re
+	}
+	return nil
+}
+
+// Apply runs every rule over the text in order
+func (r RewriteRules) Apply(text string) string {
+	for _, rule := range r {
+		text = rule.apply(text)
+	}
+	return text
+}
+
+// RewriteURL applies the url rewrites to a single url, like the uri of
+// a link card
+func (r RewriteRules) RewriteURL(u string) string {
+	for _, rule := range r {
+		u = rule.rewriteURL(u)
+	}
+	return u
+}
+
+// bskyURL is the bluesky url the rules have for a mastodon profile or
+// hashtag url, or ""
+func (r RewriteRules) bskyURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	for _, rule := range r {
+		if bsky := rule.bskyURL(u); bsky != "" {
+			return bsky
+		}
+	}
+	return ""
+}
+
+// apply does the rewrites of the rule.  The pattern is only used once
+// it's compiled by RewriteRules.Compile.
+func (r RewriteRule) apply(text string) string {
+	if r.re != nil {
+		text = r.re.ReplaceAllString(text, r.Replace)
+	}
+	if len(r.StripParams) > 0 || len(r.Profiles) > 0 || len(r.Hashtags) > 0 {
+		text = strictURLs.ReplaceAllStringFunc(text, r.rewriteURL)
+	}
+	return text
+}
+
+func (r RewriteRule) rewriteURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return raw
+	}
+	if bsky := r.bskyURL(u); bsky != "" {
+		return bsky
+	}
+	if len(r.StripParams) == 0 || u.RawQuery == "" {
+		return raw
+	}
+	var kept []string
+	for _, param := range strings.Split(u.RawQuery, "&") {
+		name, _, _ := strings.Cut(param, "=")
+		if name, err := url.QueryUnescape(name); err == nil && r.strip(name) {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	u.RawQuery = strings.Join(kept, "&")
+	return u.String()
+}
+
+func (r RewriteRule) strip(param string) bool {
+	for _, pattern := range r.StripParams {
+		if ok, _ := path.Match(pattern, param); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// bskyURL returns the bluesky equivalent of a mastodon profile or hashtag
+// url, or "" if there isn't one.
+func (r RewriteRule) bskyURL(u *url.URL) string {
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case len(segments) == 1 && strings.HasPrefix(segments[0], "@"):
+		return r.profileURL(strings.TrimPrefix(segments[0], "@"), host)
+	case len(segments) == 2 && segments[0] == "users":
+		return r.profileURL(segments[1], host)
+	case len(segments) == 2 && segments[0] == "tags":
+		for _, h := range r.Hashtags {
+			if strings.EqualFold(h, host) {
+				return "https://bsky.app/hashtag/" + url.PathEscape(segments[1])
+			}
+		}
+	}
+	return ""
+}
+
+func (r RewriteRule) profileURL(user, host string) string {
+	acct := strings.ToLower(user + "@" + host)
+	for account, handle := range r.Profiles {
+		if strings.ToLower(strings.TrimPrefix(account, "@")) == acct {
+			return "https://bsky.app/profile/" + handle
+		}
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+package bsky
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mattn/go-mastodon"
+	"github.com/rivo/uniseg"
+	"mvdan.cc/xurls/v2"
+)
+
+// MaxGraphemes is the longest post text bluesky accepts
+const MaxGraphemes = 300
+
+const ellipsis = "…"
+
+// TemplateData is what a post template is executed with.  All of the
+// fields of the toot are available along with the translated Text, e.g.
+//
+//	{{with .SpoilerText}}CW: {{.}}{{"\n\n"}}{{end}}{{.Text}}
+//
+//	🐘 original: {{.URL}}
+type TemplateData struct {
+	*mastodon.Status
+	// Text is the plain text of the toot after directives are removed
+	Text string
+}
+
+var templateFuncs = template.FuncMap{
+	"graphemes": uniseg.GraphemeClusterCount,
+	"truncate":  truncate,
+	"trim":      strings.TrimSpace,
+	"lower":     strings.ToLower,
+	"upper":     strings.ToUpper,
+	"plain":     textContent,
+	"handle":    handle,
+}
+
+var defaultTemplate = template.Must(ParseTemplate("{{.Text}}"))
+
+var attributionTemplate = template.Must(ParseTemplate(
+	"{{.Text}}\n\n— {{with .Account.DisplayName}}{{.}} {{end}}{{handle .Account}} {{.URL}}"))
+
+// ParseTemplate parses a post template with the template helper functions
+func ParseTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("post").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing post template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// handle is the full @user@server handle of an account.  Acct leaves
+// off the server for accounts on the same server as us.
+func handle(account mastodon.Account) string {
+	if strings.Contains(account.Acct, "@") {
+		return "@" + account.Acct
+	}
+	u, err := url.Parse(account.URL)
+	if err != nil || u.Host == "" {
+		return "@" + account.Acct
+	}
+	return "@" + account.Acct + "@" + u.Host
+}
+
+// render executes the template, shortening the toot text until the
+// result fits in the grapheme budget.
+func render(tmpl *template.Template, toot *mastodon.Status, text string) (string, error) {
+	data := TemplateData{Status: toot, Text: text}
+	for {
+		var buf strings.Builder
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return "", fmt.Errorf("executing post template: %w", err)
+		}
+		rendered := strings.TrimSpace(buf.String())
+		over := uniseg.GraphemeClusterCount(rendered) - MaxGraphemes
+		if over <= 0 {
+			return rendered, nil
+		}
+		budget := uniseg.GraphemeClusterCount(data.Text) - over
+		if data.Text == "" || budget <= 1 {
+			return "", fmt.Errorf("post template is %d graphemes over the limit without any toot text", over)
+		}
+		data.Text = truncate(budget, data.Text)
+	}
+}
+
+// truncate shortens s to at most n graphemes, ending it with an
+// ellipsis if anything was cut off.  It cuts between words so a link
+// isn't cut short and linked to the wrong place, and when there's only
+// one word it cuts in front of any link it would go through.
+func truncate(n int, s string) string {
+	if uniseg.GraphemeClusterCount(s) <= n {
+		return s
+	}
+	if n <= 0 {
+		return ""
+	}
+	cut := 0
+	g := uniseg.NewGraphemes(s)
+	for i := 0; i < n-1 && g.Next(); i++ {
+		_, cut = g.Positions()
+	}
+	if r, _ := utf8.DecodeRuneInString(s[cut:]); !unicode.IsSpace(r) {
+		if space := strings.LastIndexFunc(s[:cut], unicode.IsSpace); space >= 0 {
+			cut = space
+		} else {
+			for _, link := range xurls.Relaxed().FindAllStringIndex(s, -1) {
+				if link[0] < cut && cut < link[1] {
+					cut = link[0]
+					break
+				}
+			}
+		}
+	}
+	return strings.TrimRightFunc(s[:cut], unicode.IsSpace) + ellipsis
+}
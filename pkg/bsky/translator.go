@@ -5,8 +5,12 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"strings"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	appbsky "github.com/bluesky-social/indigo/api/bsky"
 	"github.com/mattn/go-mastodon"
@@ -25,24 +29,90 @@ type Card struct {
 }
 type Post struct {
 	appbsky.FeedPost
-	images map[*appbsky.EmbedImages_Image]io.ReadCloser
-	card   Card
+	// RestrictReplies adds a threadgate that allows nobody to reply.
+	// The lexicon doesn't have a postgate for quotes yet.
+	RestrictReplies bool
+	// Rkey is the record key the post is written with.  With one, posting
+	// the same post again returns the post that's already there instead
+	// of making another, see RecordKey.
+	Rkey string
+	// SourceURL is the toot the post is of.  It's saved with the post so
+	// posting again can tell it's the same post even if it would be
+	// rendered differently now.
+	SourceURL string
+	images    map[*appbsky.EmbedImages_Image]io.ReadCloser
+	card      Card
 }
 
 // translation
 
-// TODO: (willgorman) need some config about what not to convert
-// mastodon replies for example
-// TODO: (willgorman) change return type, add image/embed data to the struct
+type TranslatorConfig struct {
+	Directives Directives
+	// Rewrite rules change the toot text before it goes in the template
+	Rewrite RewriteRules
+	// Template formats the text of every post, see TemplateData
+	Template *template.Template
+	// Attribute credits the author of the toot when there isn't a
+	// Template, for sources that repost other people's toots
+	Attribute bool
+}
+
+type Translator struct {
+	config TranslatorConfig
+}
+
+func NewTranslator(cfg TranslatorConfig) *Translator {
+	return &Translator{config: cfg}
+}
+
+var defaultTranslator = NewTranslator(TranslatorConfig{Directives: DefaultDirectives})
+
+// Convert translates a toot with the default translator config
 func Convert(toot *mastodon.Status) (*Post, error) {
+	return defaultTranslator.Convert(toot)
+}
+
+// TODO: (willgorman) change return type, add image/embed data to the struct
+func (t *Translator) Convert(toot *mastodon.Status) (*Post, error) {
+	return t.ConvertText(toot, "")
+}
+
+// ConvertText translates a toot using the plain text it was written with,
+// falling back to the text of its HTML content when that's empty
+func (t *Translator) ConvertText(toot *mastodon.Status, text string) (*Post, error) {
 	result := &Post{}
-	tootText := textContent(toot.Content)
+	createdAt := toot.CreatedAt
+	if toot.Reblog != nil {
+		// a boost has no content of its own and is by the booster, so it's
+		// the boosted toot by its author, as of when it was boosted.
+		// TODO: (willgorman) a toot and a boost of it are both crossposted
+		toot, text = toot.Reblog, ""
+	}
+	tootText := text
+	if tootText == "" {
+		tootText = textContent(toot.Content)
+	}
+	labels := t.config.Directives.SelfLabels(tootText)
+	tootText = t.config.Directives.Strip(tootText)
+	tootText = t.config.Rewrite.Apply(tootText)
 
 	// TODO: (willgorman) what about Status > 300 chars?  Split into multiple FeedPost?
-	// Skip it? Truncate?  Make a link back to the original mastodon post?
+	// For now the text is truncated to fit, templates can link back to the original.
+	tmpl := t.config.Template
+	if tmpl == nil && t.config.Attribute {
+		tmpl = attributionTemplate
+	}
+	if tmpl == nil {
+		tmpl = defaultTemplate
+	}
+	tootText, err := render(tmpl, toot, tootText)
+	if err != nil {
+		return nil, err
+	}
 	result.FeedPost = appbsky.FeedPost{
-		CreatedAt: toot.CreatedAt.Format(time.RFC3339),
-		Facets:    getLinkFacets(tootText),
+		CreatedAt: createdAt.Format(time.RFC3339),
+		Facets:    t.facets(tootText, toot.Content),
+		Labels:    labels,
 		Text:      tootText,
 	}
 	// in order to take a mastodon image to an embedded bluesky
@@ -59,7 +129,7 @@ func Convert(toot *mastodon.Status) (*Post, error) {
 		}
 		resp, err := http.Get(attachment.URL)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get image from %s: %w", attachment.URL, err)
+			return nil, fmt.Errorf("%w: image from %s: %w", ErrFetchMedia, attachment.URL, err)
 		}
 		result.images[&appbsky.EmbedImages_Image{
 			Alt: attachment.Description,
@@ -78,12 +148,12 @@ func Convert(toot *mastodon.Status) (*Post, error) {
 			EmbedExternal_External: appbsky.EmbedExternal_External{
 				Description: toot.Card.Description,
 				Title:       toot.Card.Title,
-				Uri:         toot.Card.URL,
+				Uri:         t.config.Rewrite.RewriteURL(toot.Card.URL),
 			},
 		}
 		res, err := http.Get(toot.Card.Image)
 		if err != nil {
-			return nil, fmt.Errorf("failed to fetch card image from %s: %w", toot.Card.Image, err)
+			return nil, fmt.Errorf("%w: card image from %s: %w", ErrFetchMedia, toot.Card.Image, err)
 		}
 		result.card.ThumbImg = res.Body
 		result.Embed.EmbedExternal.External = &result.card.EmbedExternal_External
@@ -121,24 +191,147 @@ func textContent(s string) string {
 	return buf.String()
 }
 
+// mentionLink is the text of a mention or hashtag and the bluesky url it
+// links to
+type mentionLink struct {
+	text string
+	uri  string
+}
+
+// mentionLinks are the mention and hashtag links in HTML content that the
+// rewrite rules have a bluesky url for.  In the text they're only @user and
+// #tag, so the rules can't find them there.
+func (t *Translator) mentionLinks(content string) []mentionLink {
+	doc, err := html.Parse(strings.NewReader(content))
+	if err != nil {
+		return nil
+	}
+	var links []mentionLink
+	var find func(node *html.Node)
+	find = func(node *html.Node) {
+		if node.Type == html.ElementNode && node.Data == "a" {
+			if uri, ok := t.mention(node); ok {
+				links = append(links, mentionLink{text: nodeText(node), uri: uri})
+			}
+			return
+		}
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			find(c)
+		}
+	}
+	find(doc)
+	return links
+}
+
+// mention gives the bluesky url for a mention or hashtag link that the
+// rewrite rules have one for.  Directives are left alone.
+func (t *Translator) mention(a *html.Node) (string, bool) {
+	var href string
+	var mention bool
+	for _, attr := range a.Attr {
+		switch attr.Key {
+		case "href":
+			href = attr.Val
+		case "class":
+			for _, class := range strings.Fields(attr.Val) {
+				mention = mention || class == "mention" || class == "hashtag"
+			}
+		}
+	}
+	if !mention {
+		return "", false
+	}
+	if tag, ok := strings.CutPrefix(nodeText(a), "#"); ok && t.config.Directives.isDirective(tag) {
+		return "", false
+	}
+	bsky := t.config.Rewrite.bskyURL(href)
+	return bsky, bsky != ""
+}
+
+// nodeText is the text inside an element
+func nodeText(node *html.Node) string {
+	if node.Type == html.TextNode {
+		return node.Data
+	}
+	var text strings.Builder
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		text.WriteString(nodeText(c))
+	}
+	return text.String()
+}
+
+// facets links the urls in the post text, and the mentions and hashtags
+// from the toot content that have a bluesky url.  Those keep their text and
+// link to the url, in the order they're in the toot.
+func (t *Translator) facets(text, content string) []*appbsky.RichtextFacet {
+	facets := getLinkFacets(text)
+	linked := func(start, end int) bool {
+		for _, f := range facets {
+			if int64(start) < f.Index.ByteEnd && int64(end) > f.Index.ByteStart {
+				return true
+			}
+		}
+		return false
+	}
+	from := 0
+	for _, link := range t.mentionLinks(content) {
+		for i := from; i < len(text); {
+			n := strings.Index(text[i:], link.text)
+			if n < 0 {
+				break
+			}
+			start, end := i+n, i+n+len(link.text)
+			i = end
+			if !wordBoundary(text, start, end) || linked(start, end) {
+				continue
+			}
+			facets = append(facets, linkFacet(start, end, link.uri))
+			from = end
+			break
+		}
+	}
+	sort.Slice(facets, func(i, j int) bool { return facets[i].Index.ByteStart < facets[j].Index.ByteStart })
+	return facets
+}
+
+// wordBoundary reports whether text[start:end] isn't part of a longer
+// word, mention or hashtag, like @alice is in @alice@example.com
+func wordBoundary(text string, start, end int) bool {
+	before, _ := utf8.DecodeLastRuneInString(text[:start])
+	after, size := utf8.DecodeRuneInString(text[end:])
+	if after == '.' {
+		// the end of a sentence, but not of a domain
+		after, _ = utf8.DecodeRuneInString(text[end+size:])
+	}
+	return !inWord(before) && !inWord(after)
+}
+
+func inWord(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '@' || r == '#'
+}
+
+func linkFacet(start, end int, uri string) *appbsky.RichtextFacet {
+	return &appbsky.RichtextFacet{
+		Index: &appbsky.RichtextFacet_ByteSlice{
+			ByteEnd:   int64(end),
+			ByteStart: int64(start),
+		},
+		Features: []*appbsky.RichtextFacet_Features_Elem{
+			{
+				RichtextFacet_Link: &appbsky.RichtextFacet_Link{
+					Uri: uri,
+				},
+			},
+		},
+	}
+}
+
 func getLinkFacets(tootText string) []*appbsky.RichtextFacet {
 	urls := xurls.Relaxed()
 	links := urls.FindAllStringIndex(tootText, -1)
 	var facets []*appbsky.RichtextFacet
 	for _, link := range links {
-		facets = append(facets, &appbsky.RichtextFacet{
-			Index: &appbsky.RichtextFacet_ByteSlice{
-				ByteEnd:   int64(link[1]),
-				ByteStart: int64(link[0]),
-			},
-			Features: []*appbsky.RichtextFacet_Features_Elem{
-				{
-					RichtextFacet_Link: &appbsky.RichtextFacet_Link{
-						Uri: tootText[link[0]:link[1]],
-					},
-				},
-			},
-		})
+		facets = append(facets, linkFacet(link[0], link[1], tootText[link[0]:link[1]]))
 	}
 	return facets
 }
@@ -3,12 +3,15 @@ package bsky
 import (
 	"io"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
 	appbsky "github.com/bluesky-social/indigo/api/bsky"
 	"github.com/mattn/go-mastodon"
+	"github.com/rivo/uniseg"
 	"github.com/sanity-io/litter"
+	"github.com/spf13/viper"
 	"gotest.tools/assert"
 )
 
@@ -466,6 +469,106 @@ func TestConvert(t *testing.T) {
 	}
 }
 
+func tootWithContent(content string) *mastodon.Status {
+	return &mastodon.Status{
+		ID:         "1234",
+		Content:    content,
+		CreatedAt:  time.Unix(1, 0),
+		Visibility: "public",
+		Language:   "en",
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	directives := Directives{
+		OptOut:       []string{"nobsky"},
+		OptIn:        []string{"bsky"},
+		RequireOptIn: true,
+		Labels:       map[string]string{"bsky-cw": "graphic-media", "bsky-nsfw": "sexual"},
+	}
+	tests := []struct {
+		name       string
+		content    string
+		wantText   string
+		wantLabels []string
+		wantSkip   string
+	}{
+		{
+			name:     "opt out",
+			content:  "<p>not for bluesky <a href=\"https://example.com/tags/nobsky\" class=\"mention hashtag\" rel=\"tag\">#<span>nobsky</span></a></p>",
+			wantText: "not for bluesky",
+			wantSkip: "opted out with #nobsky",
+		},
+		{
+			name:     "not opted in",
+			content:  "<p>just for mastodon</p>",
+			wantText: "just for mastodon",
+			wantSkip: "not opted in",
+		},
+		{
+			name:     "opted in",
+			content:  "<p><a href=\"https://example.com/tags/bsky\" class=\"mention hashtag\" rel=\"tag\">#<span>bsky</span></a> hello https://example.com/page</p>",
+			wantText: "hello https://example.com/page",
+		},
+		{
+			name:       "label directive",
+			content:    "<p>spooky <a href=\"https://example.com/tags/bsky\" class=\"mention hashtag\" rel=\"tag\">#<span>bsky</span></a>-cw <a href=\"https://example.com/tags/bsky\" class=\"mention hashtag\" rel=\"tag\">#<span>BSKY</span></a> #halloween</p>",
+			wantText:   "spooky #halloween",
+			wantLabels: []string{"graphic-media"},
+		},
+		{
+			name:     "directives must be whole hashtags",
+			content:  "<p>#bskyish https://example.com/#bsky #bsky</p>",
+			wantText: "#bskyish https://example.com/#bsky",
+		},
+	}
+	translator := NewTranslator(TranslatorConfig{Directives: directives})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			toot := tootWithContent(tt.content)
+			reason, _ := directives.Skip(textContent(toot.Content))
+			assert.Equal(t, reason, tt.wantSkip)
+
+			got, err := translator.Convert(toot)
+			assert.NilError(t, err)
+			assert.Equal(t, got.Text, tt.wantText)
+			for _, facet := range got.Facets {
+				uri := facet.Features[0].RichtextFacet_Link.Uri
+				assert.Equal(t, got.Text[facet.Index.ByteStart:facet.Index.ByteEnd], uri)
+			}
+			var labels []string
+			if got.Labels != nil {
+				for _, l := range got.Labels.LabelDefs_SelfLabels.Values {
+					labels = append(labels, l.Val)
+				}
+			}
+			assert.DeepEqual(t, labels, tt.wantLabels)
+		})
+	}
+}
+
+func TestDirectivesWithDefaults(t *testing.T) {
+	d := Directives{RequireOptIn: true}.WithDefaults()
+	assert.DeepEqual(t, d, Directives{
+		OptOut:       []string{"nobsky"},
+		OptIn:        []string{"bsky"},
+		RequireOptIn: true,
+		Labels:       map[string]string{"bsky-cw": "graphic-media", "bsky-nsfw": "sexual"},
+	})
+	// changing them doesn't change the defaults
+	delete(d.Labels, "bsky-nsfw")
+	d.OptOut[0] = "nope"
+	assert.Equal(t, len(DefaultDirectives.Labels), 2)
+	assert.Equal(t, DefaultDirectives.OptOut[0], "nobsky")
+
+	// labels that are set replace the default ones, even with none
+	d = Directives{Labels: map[string]string{}}.WithDefaults()
+	assert.Equal(t, len(d.Labels), 0)
+	_, skip := d.Skip("#bsky-nsfw")
+	assert.Assert(t, !skip)
+	assert.Assert(t, d.SelfLabels("#bsky-nsfw") == nil)
+}
+
 func TestGetImg(t *testing.T) {
 	resp, err := http.Get("https://files.mastodon.social/cache/preview_cards/images/085/533/565/original/48d52fc9e782b425.jpeg")
 	assert.NilError(t, err)
@@ -475,3 +578,275 @@ func TestGetImg(t *testing.T) {
 	assert.NilError(t, err)
 	litter.Dump(data)
 }
+
+func TestTemplate(t *testing.T) {
+	long := strings.Repeat("👩‍👩‍👧 family ", 40)
+	tests := []struct {
+		name     string
+		template string
+		toot     *mastodon.Status
+		wantText string
+		// wantLen is the most graphemes the text can have
+		wantLen   int
+		wantLinks []string
+		wantErr   string
+	}{
+		{
+			name:     "link to original",
+			template: "{{.Text}}\n\n🐘 original: {{.URL}}",
+			toot:     exampleLink,
+			wantText: "post with link: https://github.com/bluesky-social/atproto/blob/main/packages/api/README.md\n\n🐘 original: https://example.com/@me/4321",
+			wantLinks: []string{
+				"https://github.com/bluesky-social/atproto/blob/main/packages/api/README.md",
+				"https://example.com/@me/4321",
+			},
+		},
+		{
+			name:     "content warning and display name",
+			template: `{{with .SpoilerText}}CW: {{.}}{{"\n\n"}}{{end}}{{.Account.DisplayName}}: {{.Text}}`,
+			toot: func() *mastodon.Status {
+				toot := tootWithContent("<p>spoilers</p>")
+				toot.SpoilerText = "movie"
+				toot.Account.DisplayName = "Me"
+				return toot
+			}(),
+			wantText: "CW: movie\n\nMe: spoilers",
+		},
+		{
+			name:     "truncated to fit",
+			template: "{{.Text}}\n\n🐘 original: {{.URL}}",
+			toot: func() *mastodon.Status {
+				toot := tootWithContent("<p>" + long + "</p>")
+				toot.URL = "https://example.com/@me/1234"
+				return toot
+			}(),
+			wantLen:   MaxGraphemes,
+			wantLinks: []string{"https://example.com/@me/1234"},
+		},
+		{
+			name:     "link isn't cut short",
+			template: "{{.Text}}",
+			toot:     tootWithContent("<p>" + strings.Repeat("a ", 140) + "https://example.com/a/long/path/to/somewhere</p>"),
+			wantText: strings.Repeat("a ", 139) + "a…",
+		},
+		{
+			name:     "template too long",
+			template: strings.Repeat("x", MaxGraphemes+1) + "{{.Text}}",
+			toot:     tootWithContent("<p>hello</p>"),
+			wantErr:  "over the limit",
+		},
+		{
+			name:     "helpers",
+			template: `{{truncate 8 .Text | upper}} ({{graphemes .Text}})`,
+			toot:     tootWithContent("<p>hello world</p>"),
+			wantText: "HELLO… (11)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ParseTemplate(tt.template)
+			assert.NilError(t, err)
+			tt.toot.Card = nil
+			got, err := NewTranslator(TranslatorConfig{Template: tmpl}).Convert(tt.toot)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+			if tt.wantText != "" {
+				assert.Equal(t, got.Text, tt.wantText)
+			}
+			if tt.wantLen != 0 {
+				assert.Assert(t, uniseg.GraphemeClusterCount(got.Text) <= tt.wantLen)
+				assert.Assert(t, strings.HasSuffix(got.Text, "…\n\n🐘 original: https://example.com/@me/1234"))
+			}
+			var links []string
+			for _, facet := range got.Facets {
+				uri := facet.Features[0].RichtextFacet_Link.Uri
+				assert.Equal(t, got.Text[facet.Index.ByteStart:facet.Index.ByteEnd], uri)
+				links = append(links, uri)
+			}
+			assert.DeepEqual(t, links, tt.wantLinks)
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		s    string
+		want string
+	}{
+		{name: "fits", n: 11, s: "hello world", want: "hello world"},
+		{name: "between words", n: 10, s: "hello world", want: "hello…"},
+		{name: "at a space", n: 7, s: "hello world", want: "hello…"},
+		{name: "before a link", n: 30, s: "see https://example.com/a/long/path", want: "see…"},
+		{name: "one long word", n: 5, s: "helloworld", want: "hell…"},
+		{name: "only a link", n: 10, s: "https://example.com/a/long/path", want: "…"},
+		{name: "link in a word", n: 12, s: "(https://example.com/a/long/path)", want: "(…"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, truncate(tt.n, tt.s), tt.want)
+		})
+	}
+}
+
+func TestAttribution(t *testing.T) {
+	toot := tootWithContent("<p>hello</p>")
+	toot.URL = "https://example.com/@me/1234"
+	toot.Account.URL = "https://example.com/@me"
+	toot.Account.Acct = "me"
+	toot.Card = nil
+
+	got, err := NewTranslator(TranslatorConfig{Attribute: true}).Convert(toot)
+	assert.NilError(t, err)
+	assert.Equal(t, got.Text, "hello\n\n— @me@example.com https://example.com/@me/1234")
+
+	toot.Account.Acct = "them@other.example"
+	toot.Account.DisplayName = "Them"
+	got, err = NewTranslator(TranslatorConfig{Attribute: true}).Convert(toot)
+	assert.NilError(t, err)
+	assert.Equal(t, got.Text, "hello\n\n— Them @them@other.example https://example.com/@me/1234")
+
+	tmpl, err := ParseTemplate("{{.Text}}")
+	assert.NilError(t, err)
+	got, err = NewTranslator(TranslatorConfig{Attribute: true, Template: tmpl}).Convert(toot)
+	assert.NilError(t, err)
+	assert.Equal(t, got.Text, "hello")
+
+	// a boost is the boosted toot, credited to its author
+	boost := tootWithContent("")
+	boost.Account.URL = "https://example.com/@booster"
+	boost.Account.Acct = "booster"
+	boost.Card = nil
+	boost.CreatedAt = time.Date(2024, 1, 20, 15, 4, 5, 0, time.UTC)
+	boost.Reblog = toot
+	got, err = NewTranslator(TranslatorConfig{Attribute: true}).Convert(boost)
+	assert.NilError(t, err)
+	assert.Equal(t, got.Text, "hello\n\n— Them @them@other.example https://example.com/@me/1234")
+	assert.Equal(t, got.CreatedAt, "2024-01-20T15:04:05Z")
+}
+
+func TestConvertText(t *testing.T) {
+	toot := tootWithContent(`<p>see <a href="https://example.com/a/long/link" rel="nofollow noopener"><span class="invisible">https://</span><span class="ellipsis">example.com/a/lo</span><span class="invisible">ng/link</span></a> #bsky</p>`)
+	toot.Card = nil
+	translator := NewTranslator(TranslatorConfig{Directives: DefaultDirectives})
+
+	got, err := translator.ConvertText(toot, "see https://example.com/a/long/link\n\n*plain* #bsky")
+	assert.NilError(t, err)
+	assert.Equal(t, got.Text, "see https://example.com/a/long/link\n\n*plain*")
+	assert.Equal(t, len(got.Facets), 1)
+
+	fallback, err := translator.ConvertText(toot, "")
+	assert.NilError(t, err)
+	converted, err := translator.Convert(toot)
+	assert.NilError(t, err)
+	assert.Equal(t, fallback.Text, converted.Text)
+}
+
+func TestRewrite(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	err := v.ReadConfig(strings.NewReader(`
+rewrite:
+  - pattern: '\bTwitter\b'
+    replace: X
+  - strip_params: ["utm_*", fbclid]
+  - profiles:
+      Alice@Mastodon.social: alice.bsky.social
+    hashtags: [mastodon.social]
+`))
+	assert.NilError(t, err)
+	var rules RewriteRules
+	assert.NilError(t, v.UnmarshalKey("rewrite", &rules))
+	assert.NilError(t, rules.Compile())
+
+	tests := []struct {
+		name string
+		text string
+		want string
+		// wantMentions are the urls mentions and hashtags link to, by
+		// their text.  Other links are to the url that's their text.
+		wantMentions map[string]string
+	}{
+		{
+			name: "pattern",
+			text: "Twitter is now Twitter",
+			want: "X is now X",
+		},
+		{
+			name: "tracking params",
+			text: "read https://example.com/a?id=1&utm_source=masto&utm_medium=social&fbclid=abc this",
+			want: "read https://example.com/a?id=1 this",
+		},
+		{
+			name: "only tracking params",
+			text: "https://example.com/a?utm_source=masto",
+			want: "https://example.com/a",
+		},
+		{
+			name: "profile",
+			text: "follow https://mastodon.social/@alice and https://mastodon.social/@bob",
+			want: "follow https://bsky.app/profile/alice.bsky.social and https://mastodon.social/@bob",
+		},
+		{
+			name: "hashtag",
+			text: "see https://mastodon.social/tags/golang not https://example.com/tags/golang",
+			want: "see https://bsky.app/hashtag/golang not https://example.com/tags/golang",
+		},
+		{
+			name: "mention",
+			text: `hi <span class="h-card" translate="no"><a href="https://mastodon.social/@alice" class="u-url mention">@<span>alice</span></a></span> ` +
+				`and <span class="h-card" translate="no"><a href="https://mastodon.social/@bob" class="u-url mention">@<span>bob</span></a></span>`,
+			want:         "hi @alice and @bob",
+			wantMentions: map[string]string{"@alice": "https://bsky.app/profile/alice.bsky.social"},
+		},
+		{
+			name: "hashtag link",
+			text: `<a href="https://mastodon.social/tags/golang" class="mention hashtag" rel="tag">#<span>golang</span></a> ` +
+				`<a href="https://example.com/tags/golang" class="mention hashtag" rel="tag">#<span>golang</span></a>`,
+			want:         "#golang #golang",
+			wantMentions: map[string]string{"#golang": "https://bsky.app/hashtag/golang"},
+		},
+		{
+			name: "mention in a link",
+			text: `<a href="https://mastodon.social/@alice" class="u-url mention">@<span>alice</span></a> ` +
+				`wrote https://example.com/@alice and @alice@example.com`,
+			want:         "@alice wrote https://example.com/@alice and @alice@example.com",
+			wantMentions: map[string]string{"@alice": "https://bsky.app/profile/alice.bsky.social"},
+		},
+		{
+			name: "directive",
+			text: `hello <a href="https://mastodon.social/tags/bsky" class="mention hashtag" rel="tag">#<span>bsky</span></a>`,
+			want: "hello",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewTranslator(TranslatorConfig{Directives: DefaultDirectives, Rewrite: rules}).Convert(tootWithContent("<p>" + tt.text + "</p>"))
+			assert.NilError(t, err)
+			assert.Equal(t, got.Text, tt.want)
+			mentions := 0
+			for i, facet := range got.Facets {
+				if i > 0 {
+					assert.Assert(t, facet.Index.ByteStart >= got.Facets[i-1].Index.ByteEnd, "facets are in order")
+				}
+				span := got.Text[facet.Index.ByteStart:facet.Index.ByteEnd]
+				uri := facet.Features[0].RichtextFacet_Link.Uri
+				if want, ok := tt.wantMentions[span]; ok {
+					assert.Equal(t, uri, want)
+					mentions++
+					continue
+				}
+				assert.Equal(t, uri, span)
+			}
+			assert.Equal(t, mentions, len(tt.wantMentions))
+		})
+	}
+
+	invalid := RewriteRules{{Pattern: "("}}
+	assert.Equal(t, invalid.Apply("(text)"), "(text)")
+	assert.ErrorContains(t, invalid.Compile(), "invalid rewrite pattern")
+}
@@ -2,9 +2,17 @@ package mastodon
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/mattn/go-mastodon"
+	"github.com/willgorman/mastodon-bsky/pkg/remote"
 )
 
 type Config struct {
@@ -13,14 +21,61 @@ type Config struct {
 	ClientSecret string `env:"CLIENT_SECRET"`
 	Username     string `env:"MASTODON_USER"`
 	Password     string `env:"MASTODON_PASSWORD"`
+	// PlainText fetches the text our own statuses were written with
+	// instead of leaving it to be worked out from their HTML content
+	PlainText bool `env:"MASTODON_PLAIN_TEXT"`
 }
 
 type Client struct {
 	*mastodon.Client
-	user *mastodon.Account
+	user      *mastodon.Account
+	plainText bool
 }
 
-type Status mastodon.Status
+// Status is a mastodon.Status with the fields that go-mastodon doesn't decode.
+type Status struct {
+	mastodon.Status
+	// ApplicationName is the name of the app that posted the status.
+	// go-mastodon's Application only has the fields for registering an app.
+	ApplicationName string
+	// Text is the plain text the status was written with.  It's only set
+	// for our own statuses when the client has PlainText set, otherwise
+	// the text has to come from Content.
+	Text string
+	// Event is the streaming event the status came from.  It's empty for
+	// new statuses from sources that don't stream.
+	Event string
+}
+
+// Streaming events a source can send statuses for.  A delete event only
+// has the ID of the status that was deleted.
+const (
+	EventUpdate = "update"
+	EventEdit   = "status.update"
+	EventDelete = "delete"
+)
+
+// IsNew reports whether the status is a new post rather than an edit or
+// delete of an old one
+func (s *Status) IsNew() bool {
+	return s.Event == "" || s.Event == EventUpdate
+}
+
+func (s *Status) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &s.Status); err != nil {
+		return err
+	}
+	var app struct {
+		Application struct {
+			Name string `json:"name"`
+		} `json:"application"`
+	}
+	if err := json.Unmarshal(data, &app); err != nil {
+		return err
+	}
+	s.ApplicationName = app.Application.Name
+	return nil
+}
 
 func NewClient(ctx context.Context, cfg Config) (*Client, error) {
 	c := mastodon.NewClient(&mastodon.Config{
@@ -31,15 +86,15 @@ func NewClient(ctx context.Context, cfg Config) (*Client, error) {
 
 	err := c.Authenticate(ctx, cfg.Username, cfg.Password)
 	if err != nil {
-		return nil, fmt.Errorf("authentication error: %w", err)
+		return nil, fmt.Errorf("authentication error: %w", networkError(err))
 	}
 
 	me, err := c.GetAccountCurrentUser(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("getting current user: %w", err)
+		return nil, fmt.Errorf("getting current user: %w", networkError(err))
 	}
 
-	return &Client{Client: c, user: me}, nil
+	return &Client{Client: c, user: me, plainText: cfg.PlainText}, nil
 }
 
 func (c *Client) GetPosts(ctx context.Context) ([]*mastodon.Status, error) {
@@ -51,3 +106,162 @@ func (c *Client) GetPosts(ctx context.Context) ([]*mastodon.Status, error) {
 	}
 	return posts, nil
 }
+
+// Account is the account the client is logged in to
+func (c *Client) Account() *mastodon.Account {
+	return c.user
+}
+
+// MovedError is sent by a source when its account has moved to another
+// server, after which the account doesn't post anything
+type MovedError struct {
+	Account mastodon.Account
+	MovedTo mastodon.Account
+}
+
+func (e *MovedError) Error() string {
+	return fmt.Sprintf("account %s has moved to %s", e.Account.URL, e.MovedTo.URL)
+}
+
+// CheckMoved gets the logged in account again and returns a MovedError if
+// it has moved
+func (c *Client) CheckMoved(ctx context.Context) error {
+	var account mastodon.Account
+	if _, err := c.get(ctx, "/api/v1/accounts/verify_credentials", nil, &account); err != nil {
+		return fmt.Errorf("getting current user: %w", err)
+	}
+	if account.Moved != nil {
+		return &MovedError{Account: account, MovedTo: *account.Moved}
+	}
+	return nil
+}
+
+// RateLimit is read from the X-RateLimit headers of a response
+type RateLimit struct {
+	Remaining int
+	Reset     time.Time
+}
+
+// Exhausted reports whether requests have to wait for the rate limit reset
+func (r RateLimit) Exhausted(now time.Time) bool {
+	return r.Remaining <= 0 && r.Reset.After(now)
+}
+
+func parseRateLimit(h http.Header) (RateLimit, bool) {
+	remaining, err := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return RateLimit{}, false
+	}
+	reset, err := time.Parse(time.RFC3339, h.Get("X-RateLimit-Reset"))
+	if err != nil {
+		return RateLimit{}, false
+	}
+	return RateLimit{Remaining: remaining, Reset: reset}, true
+}
+
+// ErrRateLimited matches the error returned when the server responds
+// with 429
+var ErrRateLimited = remote.ErrRateLimited
+
+// AccountStatuses gets a page of statuses posted by the logged in account.
+// go-mastodon doesn't expose the response headers or decode everything in
+// Status so this makes the request itself.
+func (c *Client) AccountStatuses(ctx context.Context, params url.Values) ([]Status, RateLimit, error) {
+	statuses, limit, err := c.statuses(ctx, fmt.Sprintf("/api/v1/accounts/%s/statuses", url.PathEscape(string(c.user.ID))), params)
+	if err != nil {
+		return nil, limit, fmt.Errorf("failed to get posts: %w", err)
+	}
+	return statuses, limit, nil
+}
+
+// HashtagStatuses gets a page of public statuses with the hashtag
+func (c *Client) HashtagStatuses(ctx context.Context, tag string, params url.Values) ([]Status, RateLimit, error) {
+	statuses, limit, err := c.statuses(ctx, "/api/v1/timelines/tag/"+url.PathEscape(strings.TrimPrefix(tag, "#")), params)
+	if err != nil {
+		return nil, limit, fmt.Errorf("failed to get #%s timeline: %w", tag, err)
+	}
+	return statuses, limit, nil
+}
+
+// ListStatuses gets a page of statuses from accounts in one of our lists
+func (c *Client) ListStatuses(ctx context.Context, listID string, params url.Values) ([]Status, RateLimit, error) {
+	statuses, limit, err := c.statuses(ctx, "/api/v1/timelines/list/"+url.PathEscape(listID), params)
+	if err != nil {
+		return nil, limit, fmt.Errorf("failed to get list %s timeline: %w", listID, err)
+	}
+	return statuses, limit, nil
+}
+
+func (c *Client) statuses(ctx context.Context, path string, params url.Values) ([]Status, RateLimit, error) {
+	var statuses []Status
+	limit, err := c.get(ctx, path, params, &statuses)
+	if err != nil {
+		return nil, limit, err
+	}
+	for i := range statuses {
+		if sourceLimit, err := c.addText(ctx, &statuses[i]); err != nil {
+			return nil, sourceLimit, err
+		}
+	}
+	return statuses, limit, nil
+}
+
+// StatusSource gets the plain text a status was written with.  It's only
+// there for our own statuses.
+func (c *Client) StatusSource(ctx context.Context, id mastodon.ID) (string, RateLimit, error) {
+	var source struct {
+		Text string `json:"text"`
+	}
+	limit, err := c.get(ctx, "/api/v1/statuses/"+url.PathEscape(string(id))+"/source", nil, &source)
+	if err != nil {
+		return "", limit, fmt.Errorf("failed to get source of %s: %w", id, err)
+	}
+	return source.Text, limit, nil
+}
+
+// addText sets the Text of our own statuses when the client has PlainText
+// set.  Statuses from before the source endpoint existed don't have one,
+// so only rate limits are errors and everything else leaves Text empty
+// for the translator to fall back to Content.
+func (c *Client) addText(ctx context.Context, status *Status) (RateLimit, error) {
+	if !c.plainText || status.Reblog != nil || c.user == nil || status.Account.ID != c.user.ID {
+		return RateLimit{}, nil
+	}
+	text, limit, err := c.StatusSource(ctx, status.ID)
+	if errors.Is(err, ErrRateLimited) || ctx.Err() != nil {
+		return limit, err
+	}
+	status.Text = text
+	return limit, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, params url.Values, out any) (RateLimit, error) {
+	u, err := url.Parse(c.Config.Server)
+	if err != nil {
+		return RateLimit{}, err
+	}
+	u = u.JoinPath(path)
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return RateLimit{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Config.AccessToken)
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return RateLimit{}, networkError(err)
+	}
+	defer resp.Body.Close()
+
+	limit, _ := parseRateLimit(resp.Header)
+	if resp.StatusCode != http.StatusOK {
+		return limit, statusError(resp, path)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return limit, fmt.Errorf("decoding response from %s: %w", path, err)
+	}
+	return limit, nil
+}
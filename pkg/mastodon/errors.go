@@ -0,0 +1,51 @@
+package mastodon
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/willgorman/mastodon-bsky/pkg/remote"
+)
+
+// service is the remote.Error Service of errors from the mastodon server
+const service = "mastodon"
+
+// statusError is the error for a response that wasn't 200.  Rate limited
+// errors are also ErrRateLimited.
+func statusError(resp *http.Response, uri string) *remote.Error {
+	e := &remote.Error{
+		Service:    service,
+		Kind:       remote.KindForStatus(resp.StatusCode),
+		StatusCode: resp.StatusCode,
+		Err:        fmt.Errorf("unexpected status from %s: %s", uri, resp.Status),
+	}
+	if e.Kind == remote.RateLimited {
+		e.RetryAfter = retryAfter(resp.Header, time.Now())
+	}
+	return e
+}
+
+// networkError classifies an error from making a request.  Anything that
+// isn't a network error is returned as is.
+func networkError(err error) error {
+	return remote.NetworkError(service, err)
+}
+
+// retryAfter reads Retry-After, as seconds or a date, and falls back to
+// X-RateLimit-Reset
+func retryAfter(h http.Header, now time.Time) time.Time {
+	if v := h.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil {
+			return now.Add(time.Duration(secs) * time.Second)
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return t
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, h.Get("X-RateLimit-Reset")); err == nil {
+		return t
+	}
+	return time.Time{}
+}
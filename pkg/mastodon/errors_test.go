@@ -0,0 +1,84 @@
+package mastodon_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/willgorman/mastodon-bsky/pkg/mastodon"
+	"github.com/willgorman/mastodon-bsky/pkg/remote"
+	"gotest.tools/assert"
+)
+
+func TestClientErrors(t *testing.T) {
+	reset := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	tests := []struct {
+		name      string
+		status    int
+		header    http.Header
+		kind      remote.Kind
+		transient bool
+		retry     time.Time
+	}{
+		{name: "unauthorized", status: http.StatusUnauthorized, kind: remote.AuthExpired},
+		{
+			name:      "rate limited",
+			status:    http.StatusTooManyRequests,
+			header:    http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {reset.Format(time.RFC3339)}},
+			kind:      remote.RateLimited,
+			transient: true,
+			retry:     reset,
+		},
+		{
+			name:      "retry after",
+			status:    http.StatusTooManyRequests,
+			header:    http.Header{"Retry-After": {reset.Format(http.TimeFormat)}},
+			kind:      remote.RateLimited,
+			transient: true,
+			retry:     reset,
+		},
+		{name: "invalid request", status: http.StatusUnprocessableEntity, kind: remote.InvalidRequest},
+		{name: "not found", status: http.StatusNotFound, kind: remote.NotFound},
+		{name: "gone", status: http.StatusGone, kind: remote.NotFound},
+		{name: "upstream", status: http.StatusServiceUnavailable, kind: remote.Upstream, transient: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer failing.Close()
+			c := newFakeMastodon(t).client(t)
+			c.Config.Server = failing.URL
+
+			_, _, err := c.StatusSource(context.Background(), "1")
+			var merr *remote.Error
+			assert.Assert(t, errors.As(err, &merr), "got %v", err)
+			assert.Equal(t, merr.Kind, tt.kind)
+			assert.Equal(t, merr.StatusCode, tt.status)
+			assert.Equal(t, merr.Transient(), tt.transient)
+			assert.Assert(t, merr.RetryAfter.Equal(tt.retry), "got %s", merr.RetryAfter)
+			assert.Equal(t, errors.Is(err, mastodon.ErrRateLimited), tt.kind == remote.RateLimited)
+		})
+	}
+}
+
+func TestClientNetworkError(t *testing.T) {
+	c := newFakeMastodon(t).client(t)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	c.Config.Server = closed.URL
+
+	_, _, err := c.AccountStatuses(context.Background(), nil)
+	var merr *remote.Error
+	assert.Assert(t, errors.As(err, &merr), "got %v", err)
+	assert.Equal(t, merr.Kind, remote.Network)
+	assert.Equal(t, merr.Service, "mastodon")
+	assert.Assert(t, merr.Transient())
+}
@@ -0,0 +1,252 @@
+package mastodon
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Filter decides which statuses get crossposted.  A status is skipped when
+// there are include rules and it matches none of them, or when it matches
+// any of the exclude rules.
+type Filter struct {
+	Include []Rule `mapstructure:"include"`
+	Exclude []Rule `mapstructure:"exclude"`
+}
+
+// Rule matches a status when every condition that is set on it matches.
+// Conditions that take a list match if any item in the list matches.
+type Rule struct {
+	Hashtags     []string      `mapstructure:"hashtags"`
+	Text         string        `mapstructure:"text"`
+	Languages    []string      `mapstructure:"languages"`
+	HasMedia     *bool         `mapstructure:"has_media"`
+	Applications []string      `mapstructure:"applications"`
+	Reply        *bool         `mapstructure:"reply"`
+	Boost        *bool         `mapstructure:"boost"`
+	Pinned       *bool         `mapstructure:"pinned"`
+	OlderThan    time.Duration `mapstructure:"older_than"`
+	NewerThan    time.Duration `mapstructure:"newer_than"`
+
+	text *regexp.Regexp
+}
+
+// Compile checks the rules and compiles their regular expressions.
+func (f *Filter) Compile() error {
+	for _, rules := range [][]Rule{f.Include, f.Exclude} {
+		for i := range rules {
+			if rules[i].Text == "" {
+				continue
+			}
+			re, err := regexp.Compile(rules[i].Text)
+			if err != nil {
+				return fmt.Errorf("invalid text rule %q: %w", rules[i].Text, err)
+			}
+			rules[i].text = re
+		}
+	}
+	return nil
+}
+
+// Skip returns the reason a status should not be crossposted, or false
+// if it passes the filter.
+func (f Filter) Skip(status *Status, now time.Time) (string, bool) {
+	for _, rule := range f.Exclude {
+		if rule.Match(status, now) {
+			return fmt.Sprintf("excluded by rule: %s", rule), true
+		}
+	}
+	if len(f.Include) == 0 {
+		return "", false
+	}
+	for _, rule := range f.Include {
+		if rule.Match(status, now) {
+			return "", false
+		}
+	}
+	return "not matched by any include rule", true
+}
+
+// Match reports whether the status meets every condition of the rule.  A
+// text condition needs Filter.Compile first, it never matches before then.
+func (r Rule) Match(status *Status, now time.Time) bool {
+	if len(r.Hashtags) > 0 && !hasAnyTag(status, r.Hashtags) {
+		return false
+	}
+	if r.Text != "" && (r.text == nil || !r.text.MatchString(PlainText(status.Content))) {
+		return false
+	}
+	if len(r.Languages) > 0 && !containsFold(r.Languages, status.Language) {
+		return false
+	}
+	if r.HasMedia != nil && *r.HasMedia != (len(status.MediaAttachments) > 0) {
+		return false
+	}
+	if len(r.Applications) > 0 && !containsFold(r.Applications, status.ApplicationName) {
+		return false
+	}
+	if r.Reply != nil && *r.Reply != (status.InReplyToID != nil) {
+		return false
+	}
+	if r.Boost != nil && *r.Boost != (status.Reblog != nil) {
+		return false
+	}
+	if r.Pinned != nil && *r.Pinned != (status.Pinned == true) {
+		return false
+	}
+	age := now.Sub(status.CreatedAt)
+	if r.OlderThan > 0 && age <= r.OlderThan {
+		return false
+	}
+	if r.NewerThan > 0 && age >= r.NewerThan {
+		return false
+	}
+	return true
+}
+
+func (r Rule) String() string {
+	conds := r.conds()
+	if len(conds) == 0 {
+		return "any"
+	}
+	return strings.Join(conds, ", ")
+}
+
+func (r Rule) conds() []string {
+	var conds []string
+	if len(r.Hashtags) > 0 {
+		conds = append(conds, fmt.Sprintf("hashtags %v", r.Hashtags))
+	}
+	if r.Text != "" {
+		conds = append(conds, fmt.Sprintf("text %q", r.Text))
+	}
+	if len(r.Languages) > 0 {
+		conds = append(conds, fmt.Sprintf("languages %v", r.Languages))
+	}
+	if r.HasMedia != nil {
+		conds = append(conds, fmt.Sprintf("has_media %t", *r.HasMedia))
+	}
+	if len(r.Applications) > 0 {
+		conds = append(conds, fmt.Sprintf("applications %v", r.Applications))
+	}
+	if r.Reply != nil {
+		conds = append(conds, fmt.Sprintf("reply %t", *r.Reply))
+	}
+	if r.Boost != nil {
+		conds = append(conds, fmt.Sprintf("boost %t", *r.Boost))
+	}
+	if r.Pinned != nil {
+		conds = append(conds, fmt.Sprintf("pinned %t", *r.Pinned))
+	}
+	if r.OlderThan > 0 {
+		conds = append(conds, fmt.Sprintf("older_than %s", r.OlderThan))
+	}
+	if r.NewerThan > 0 {
+		conds = append(conds, fmt.Sprintf("newer_than %s", r.NewerThan))
+	}
+	return conds
+}
+
+// Params returns the account statuses query parameters that filter out
+// statuses on the server.  They only ever drop statuses that Skip would
+// skip anyway, everything else is still filtered by Skip.
+func (f Filter) Params() url.Values {
+	params := url.Values{}
+	// exclude_replies only drops replies to other accounts, which is
+	// less than an exclude rule for all replies drops
+	if f.excludes(func(r Rule) bool { return r.Reply != nil && *r.Reply }) ||
+		f.requires(func(r Rule) bool { return r.Reply != nil && !*r.Reply }) {
+		params.Set("exclude_replies", "true")
+	}
+	if f.excludes(func(r Rule) bool { return r.Boost != nil && *r.Boost }) ||
+		f.requires(func(r Rule) bool { return r.Boost != nil && !*r.Boost }) {
+		params.Set("exclude_reblogs", "true")
+	}
+	if f.requires(func(r Rule) bool { return r.HasMedia != nil && *r.HasMedia }) {
+		params.Set("only_media", "true")
+	}
+	if f.requires(func(r Rule) bool { return r.Pinned != nil && *r.Pinned }) {
+		params.Set("pinned", "true")
+	}
+	if len(f.Include) > 0 && len(f.Include[0].Hashtags) == 1 {
+		tag := strings.TrimPrefix(f.Include[0].Hashtags[0], "#")
+		if f.requires(func(r Rule) bool {
+			return len(r.Hashtags) == 1 && strings.EqualFold(strings.TrimPrefix(r.Hashtags[0], "#"), tag)
+		}) {
+			params.Set("tagged", tag)
+		}
+	}
+	return params
+}
+
+// excludes reports whether there's an exclude rule that has only the
+// condition cond checks for.  Rules with more conditions match fewer
+// statuses so they can't be done by the server.
+func (f Filter) excludes(cond func(Rule) bool) bool {
+	for _, r := range f.Exclude {
+		if cond(r) && len(r.conds()) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// requires reports whether every include rule has the condition
+func (f Filter) requires(cond func(Rule) bool) bool {
+	if len(f.Include) == 0 {
+		return false
+	}
+	for _, r := range f.Include {
+		if !cond(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasAnyTag(status *Status, tags []string) bool {
+	for _, tag := range status.Tags {
+		if containsFold(tags, tag.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(strings.TrimPrefix(item, "#"), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// PlainText strips the html from status content, putting paragraphs
+// and line breaks on their own lines.
+func PlainText(content string) string {
+	var buf strings.Builder
+	z := html.NewTokenizer(strings.NewReader(content))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return strings.TrimSpace(buf.String())
+		case html.TextToken:
+			buf.Write(z.Text())
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			if string(name) == "br" {
+				buf.WriteString("\n")
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			if string(name) == "p" {
+				buf.WriteString("\n\n")
+			}
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package mastodon_test
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	gomastodon "github.com/mattn/go-mastodon"
+	"github.com/spf13/viper"
+	"github.com/willgorman/mastodon-bsky/pkg/mastodon"
+	"gotest.tools/assert"
+)
+
+var now = time.Date(2024, 1, 20, 12, 0, 0, 0, time.UTC)
+
+func status(content string, modify func(s *mastodon.Status)) *mastodon.Status {
+	s := &mastodon.Status{Status: gomastodon.Status{
+		ID:         "1",
+		Content:    content,
+		CreatedAt:  now.Add(-time.Hour),
+		Visibility: gomastodon.VisibilityPublic,
+		Language:   "en",
+	}}
+	if modify != nil {
+		modify(s)
+	}
+	return s
+}
+
+func boolp(b bool) *bool {
+	return &b
+}
+
+func TestFilterSkip(t *testing.T) {
+	tests := []struct {
+		name     string
+		filter   mastodon.Filter
+		status   *mastodon.Status
+		wantSkip bool
+	}{
+		{
+			name:   "empty filter allows everything",
+			status: status("<p>hello</p>", nil),
+		},
+		{
+			name:   "excluded hashtag",
+			filter: mastodon.Filter{Exclude: []mastodon.Rule{{Hashtags: []string{"#NoBsky"}}}},
+			status: status("<p>hello #nobsky</p>", func(s *mastodon.Status) {
+				s.Tags = []gomastodon.Tag{{Name: "nobsky"}}
+			}),
+			wantSkip: true,
+		},
+		{
+			name:     "included hashtag missing",
+			filter:   mastodon.Filter{Include: []mastodon.Rule{{Hashtags: []string{"bsky"}}}},
+			status:   status("<p>hello</p>", nil),
+			wantSkip: true,
+		},
+		{
+			name:   "included hashtag present",
+			filter: mastodon.Filter{Include: []mastodon.Rule{{Hashtags: []string{"bsky"}}}},
+			status: status("<p>hello #bsky</p>", func(s *mastodon.Status) {
+				s.Tags = []gomastodon.Tag{{Name: "bsky"}}
+			}),
+		},
+		{
+			name:     "text regex",
+			filter:   mastodon.Filter{Exclude: []mastodon.Rule{{Text: `(?i)^re:`}}},
+			status:   status("<p>Re: something</p>", nil),
+			wantSkip: true,
+		},
+		{
+			name:     "language",
+			filter:   mastodon.Filter{Include: []mastodon.Rule{{Languages: []string{"de"}}}},
+			status:   status("<p>hello</p>", nil),
+			wantSkip: true,
+		},
+		{
+			name:   "has media",
+			filter: mastodon.Filter{Exclude: []mastodon.Rule{{HasMedia: boolp(true)}}},
+			status: status("<p>hello</p>", func(s *mastodon.Status) {
+				s.MediaAttachments = []gomastodon.Attachment{{Type: "image"}}
+			}),
+			wantSkip: true,
+		},
+		{
+			name:   "application",
+			filter: mastodon.Filter{Exclude: []mastodon.Rule{{Applications: []string{"Moa"}}}},
+			status: status("<p>hello</p>", func(s *mastodon.Status) {
+				s.ApplicationName = "moa"
+			}),
+			wantSkip: true,
+		},
+		{
+			name:   "reply",
+			filter: mastodon.Filter{Exclude: []mastodon.Rule{{Reply: boolp(true)}}},
+			status: status("<p>hello</p>", func(s *mastodon.Status) {
+				s.InReplyToID = "2"
+			}),
+			wantSkip: true,
+		},
+		{
+			name:   "boost",
+			filter: mastodon.Filter{Exclude: []mastodon.Rule{{Boost: boolp(true)}}},
+			status: status("", func(s *mastodon.Status) {
+				s.Reblog = &gomastodon.Status{ID: "3"}
+			}),
+			wantSkip: true,
+		},
+		{
+			name:     "too old",
+			filter:   mastodon.Filter{Exclude: []mastodon.Rule{{OlderThan: 30 * time.Minute}}},
+			status:   status("<p>hello</p>", nil),
+			wantSkip: true,
+		},
+		{
+			name:   "all conditions of a rule must match",
+			filter: mastodon.Filter{Exclude: []mastodon.Rule{{Languages: []string{"en"}, Reply: boolp(true)}}},
+			status: status("<p>hello</p>", nil),
+		},
+		{
+			name: "exclude wins over include",
+			filter: mastodon.Filter{
+				Include: []mastodon.Rule{{Languages: []string{"en"}}},
+				Exclude: []mastodon.Rule{{Text: "hello"}},
+			},
+			status:   status("<p>hello</p>", nil),
+			wantSkip: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.NilError(t, tt.filter.Compile())
+			reason, skip := tt.filter.Skip(tt.status, now)
+			assert.Equal(t, skip, tt.wantSkip, reason)
+			if skip {
+				assert.Assert(t, reason != "")
+			}
+		})
+	}
+}
+
+func TestFilterFromConfig(t *testing.T) {
+	v := viper.New()
+	v.SetConfigType("yaml")
+	err := v.ReadConfig(strings.NewReader(`
+filters:
+  include:
+    - languages: [en]
+  exclude:
+    - hashtags: [nobsky]
+    - reply: true
+      older_than: 48h
+    - text: "(?i)spoiler"
+`))
+	assert.NilError(t, err)
+
+	var filter mastodon.Filter
+	assert.NilError(t, v.UnmarshalKey("filters", &filter))
+	assert.NilError(t, filter.Compile())
+	assert.Equal(t, len(filter.Include), 1)
+	assert.Equal(t, len(filter.Exclude), 3)
+	assert.Equal(t, filter.Exclude[1].OlderThan, 48*time.Hour)
+	assert.Equal(t, *filter.Exclude[1].Reply, true)
+
+	reason, skip := filter.Skip(status("<p>big SPOILER</p>", nil), now)
+	assert.Assert(t, skip)
+	assert.Equal(t, reason, `excluded by rule: text "(?i)spoiler"`)
+}
+
+func TestFilterCompileError(t *testing.T) {
+	filter := mastodon.Filter{Exclude: []mastodon.Rule{{Text: "("}}}
+	// it's an error to compile, and doesn't match anything without
+	_, skip := filter.Skip(status("<p>(</p>", nil), now)
+	assert.Assert(t, !skip)
+	assert.ErrorContains(t, filter.Compile(), "invalid text rule")
+}
+
+func TestPlainText(t *testing.T) {
+	assert.Equal(t, mastodon.PlainText("<p>one<br>two</p><p>three &amp; four</p>"), "one\ntwo\n\nthree & four")
+}
+
+func TestFilterParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter mastodon.Filter
+		want   url.Values
+	}{
+		{
+			name: "no filter",
+			want: url.Values{},
+		},
+		{
+			name: "exclude replies and boosts",
+			filter: mastodon.Filter{Exclude: []mastodon.Rule{
+				{Reply: boolp(true)},
+				{Boost: boolp(true)},
+			}},
+			want: url.Values{"exclude_replies": {"true"}, "exclude_reblogs": {"true"}},
+		},
+		{
+			name: "narrower exclude rules stay client side",
+			filter: mastodon.Filter{Exclude: []mastodon.Rule{
+				{Reply: boolp(true), Languages: []string{"de"}},
+				{Boost: boolp(false)},
+			}},
+			want: url.Values{},
+		},
+		{
+			name: "every include rule needs media",
+			filter: mastodon.Filter{Include: []mastodon.Rule{
+				{HasMedia: boolp(true), Languages: []string{"en"}},
+				{HasMedia: boolp(true), Hashtags: []string{"art"}},
+			}},
+			want: url.Values{"only_media": {"true"}},
+		},
+		{
+			name: "only some include rules need media",
+			filter: mastodon.Filter{Include: []mastodon.Rule{
+				{HasMedia: boolp(true)},
+				{Languages: []string{"en"}},
+			}},
+			want: url.Values{},
+		},
+		{
+			name: "include rules for originals with one hashtag",
+			filter: mastodon.Filter{Include: []mastodon.Rule{
+				{Hashtags: []string{"#Bsky"}, Reply: boolp(false), Boost: boolp(false)},
+				{Hashtags: []string{"bsky"}, Reply: boolp(false), Boost: boolp(false), Pinned: boolp(true)},
+			}},
+			want: url.Values{"tagged": {"Bsky"}, "exclude_replies": {"true"}, "exclude_reblogs": {"true"}},
+		},
+		{
+			name:   "pinned",
+			filter: mastodon.Filter{Include: []mastodon.Rule{{Pinned: boolp(true)}}},
+			want:   url.Values{"pinned": {"true"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.DeepEqual(t, tt.filter.Params(), tt.want)
+		})
+	}
+}
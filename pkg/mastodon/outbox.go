@@ -0,0 +1,400 @@
+package mastodon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	"github.com/willgorman/mastodon-bsky/pkg/remote"
+)
+
+// Outbox reads the public posts of an account from its ActivityPub outbox
+// so accounts can be mirrored without their credentials.  Everything that
+// federates has an outbox, including GoToSocial, Akkoma and Misskey
+// servers that don't have the mastodon API.
+type Outbox struct {
+	client *http.Client
+	Actor  Actor
+}
+
+// Actor is the ActivityPub actor of an account
+type Actor struct {
+	ID                string `json:"id"`
+	PreferredUsername string `json:"preferredUsername"`
+	Name              string `json:"name"`
+	Summary           string `json:"summary"`
+	URL               link   `json:"url"`
+	Outbox            string `json:"outbox"`
+	Followers         string `json:"followers"`
+	Icon              struct {
+		URL link `json:"url"`
+	} `json:"icon"`
+}
+
+const activityJSON = `application/activity+json, application/ld+json; profile="https://www.w3.org/ns/activitystreams"`
+
+// publicAudience is the special collection of everyone, servers use all
+// three forms of it
+var publicAudience = []string{"https://www.w3.org/ns/activitystreams#Public", "as:Public", "Public"}
+
+// maxOutboxPages limits how far back the outbox is read looking for the
+// last status that was sent
+const maxOutboxPages = 10
+
+// ErrCheckpointNotFound is returned when the outbox doesn't go back as far
+// as the last status that was sent, so which statuses are new isn't known
+var ErrCheckpointNotFound = errors.New("checkpoint not found in outbox")
+
+// NewOutbox finds the actor for account, which is either the actor URL or
+// a @user@server handle that is looked up with WebFinger.
+func NewOutbox(ctx context.Context, client *http.Client, account string) (*Outbox, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	o := &Outbox{client: client}
+	actorURL := account
+	if !strings.HasPrefix(account, "https://") && !strings.HasPrefix(account, "http://") {
+		var err error
+		actorURL, err = o.webfinger(ctx, account)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := o.get(ctx, actorURL, &o.Actor); err != nil {
+		return nil, fmt.Errorf("getting actor %s: %w", actorURL, err)
+	}
+	if o.Actor.Outbox == "" {
+		return nil, fmt.Errorf("actor %s has no outbox", actorURL)
+	}
+	return o, nil
+}
+
+func (o *Outbox) webfinger(ctx context.Context, account string) (string, error) {
+	acct := strings.TrimPrefix(account, "@")
+	_, host, ok := strings.Cut(acct, "@")
+	if !ok {
+		return "", fmt.Errorf("account %q is not an actor URL or @user@server", account)
+	}
+	u := url.URL{Scheme: "https", Host: host, Path: "/.well-known/webfinger"}
+	u.RawQuery = url.Values{"resource": {"acct:" + acct}}.Encode()
+	var finger struct {
+		Links []struct {
+			Rel  string `json:"rel"`
+			Type string `json:"type"`
+			Href string `json:"href"`
+		} `json:"links"`
+	}
+	if _, err := o.get(ctx, u.String(), &finger); err != nil {
+		return "", fmt.Errorf("looking up %s: %w", account, err)
+	}
+	for _, l := range finger.Links {
+		if l.Rel == "self" && (l.Type == "application/activity+json" || strings.HasPrefix(l.Type, "application/ld+json")) {
+			return l.Href, nil
+		}
+	}
+	return "", fmt.Errorf("no actor for %s", account)
+}
+
+// Account is the actor as a mastodon account
+func (o *Outbox) Account() mastodon.Account {
+	account := mastodon.Account{
+		ID:          mastodon.ID(o.Actor.ID),
+		Username:    o.Actor.PreferredUsername,
+		Acct:        o.Actor.PreferredUsername,
+		DisplayName: o.Actor.Name,
+		Note:        o.Actor.Summary,
+		URL:         string(o.Actor.URL),
+		Avatar:      string(o.Actor.Icon.URL),
+	}
+	if account.URL == "" {
+		account.URL = o.Actor.ID
+	}
+	if u, err := url.Parse(o.Actor.ID); err == nil {
+		account.Acct += "@" + u.Host
+	}
+	return account
+}
+
+// Statuses gets the statuses in the outbox that are newer than the
+// min_id param, newest first like the mastodon timelines.  Outboxes can't
+// be paged from an ID so this reads from the newest page until it finds
+// min_id, and returns ErrCheckpointNotFound if it doesn't within
+// maxOutboxPages.  Without min_id it's just the newest page.
+func (o *Outbox) Statuses(ctx context.Context, params url.Values) ([]Status, RateLimit, error) {
+	minID := params.Get("min_id")
+	var collection struct {
+		First json.RawMessage `json:"first"`
+		outboxPage
+	}
+	limit, err := o.get(ctx, o.Actor.Outbox, &collection)
+	if err != nil {
+		return nil, limit, fmt.Errorf("failed to get outbox: %w", err)
+	}
+	page := collection.outboxPage
+	if len(collection.First) > 0 {
+		if page, limit, err = o.page(ctx, collection.First); err != nil {
+			return nil, limit, err
+		}
+	}
+
+	var statuses []Status
+	for pages := 1; ; pages++ {
+		for _, item := range page.OrderedItems {
+			status, ok, err := o.status(ctx, item)
+			if err != nil {
+				return nil, limit, err
+			}
+			// checkpoints can be activities that are skipped now
+			if minID != "" && string(status.ID) == minID {
+				return statuses, limit, nil
+			}
+			if !ok {
+				continue
+			}
+			statuses = append(statuses, status)
+		}
+		if minID == "" {
+			return statuses, limit, nil
+		}
+		if page.Next == "" || pages >= maxOutboxPages {
+			// sending everything as new could crosspost the whole outbox
+			return nil, limit, fmt.Errorf("%w: %s isn't in the newest %d pages, use --since to start from a newer status",
+				ErrCheckpointNotFound, minID, pages)
+		}
+		if page, limit, err = o.page(ctx, json.RawMessage(fmt.Sprintf("%q", page.Next))); err != nil {
+			return nil, limit, err
+		}
+	}
+}
+
+type outboxPage struct {
+	OrderedItems []json.RawMessage `json:"orderedItems"`
+	Next         string            `json:"next"`
+}
+
+// page decodes a collection page, getting it first if it's a URL
+func (o *Outbox) page(ctx context.Context, raw json.RawMessage) (outboxPage, RateLimit, error) {
+	var page outboxPage
+	var uri string
+	if json.Unmarshal(raw, &uri) != nil {
+		return page, RateLimit{}, json.Unmarshal(raw, &page)
+	}
+	limit, err := o.get(ctx, uri, &page)
+	if err != nil {
+		return page, limit, fmt.Errorf("failed to get outbox page: %w", err)
+	}
+	return page, limit, nil
+}
+
+type activity struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type note struct {
+	ID         string            `json:"id"`
+	Type       string            `json:"type"`
+	Summary    string            `json:"summary"`
+	InReplyTo  string            `json:"inReplyTo"`
+	Published  time.Time         `json:"published"`
+	URL        link              `json:"url"`
+	To         audience          `json:"to"`
+	CC         audience          `json:"cc"`
+	Sensitive  bool              `json:"sensitive"`
+	Content    string            `json:"content"`
+	ContentMap map[string]string `json:"contentMap"`
+	Attachment []struct {
+		Type      string `json:"type"`
+		MediaType string `json:"mediaType"`
+		URL       link   `json:"url"`
+		Name      string `json:"name"`
+	} `json:"attachment"`
+	Tag []struct {
+		Type string `json:"type"`
+		Href string `json:"href"`
+		Name string `json:"name"`
+	} `json:"tag"`
+}
+
+// status maps a Create activity in the outbox to a status.  Everything
+// else, like boosts, likes and deletes, is ignored and only has its ID.
+// Boosts would need the boosted post from its own server, which is the
+// content that would be crossposted.
+// TODO: (willgorman) crosspost boosts as reposts
+func (o *Outbox) status(ctx context.Context, raw json.RawMessage) (Status, bool, error) {
+	var act activity
+	if err := o.object(ctx, raw, &act); err != nil {
+		return Status{}, false, err
+	}
+	ignored := Status{Status: mastodon.Status{ID: mastodon.ID(act.ID)}}
+	switch act.Type {
+	case "Create":
+		var n note
+		if err := o.object(ctx, act.Object, &n); err != nil {
+			return Status{}, false, err
+		}
+		if n.Type != "Note" && n.Type != "Article" && n.Type != "Question" {
+			return ignored, false, nil
+		}
+		return o.noteStatus(n), true, nil
+	}
+	return ignored, false, nil
+}
+
+func (o *Outbox) noteStatus(n note) Status {
+	s := mastodon.Status{
+		ID:          mastodon.ID(n.ID),
+		URI:         n.ID,
+		URL:         string(n.URL),
+		Account:     o.Account(),
+		Content:     n.Content,
+		CreatedAt:   n.Published,
+		Sensitive:   n.Sensitive,
+		SpoilerText: n.Summary,
+		Visibility:  o.visibility(n.To, n.CC),
+	}
+	if s.URL == "" {
+		s.URL = n.ID
+	}
+	if n.InReplyTo != "" {
+		s.InReplyToID = n.InReplyTo
+	}
+	if len(n.ContentMap) == 1 {
+		for lang := range n.ContentMap {
+			s.Language = lang
+		}
+	}
+	for _, a := range n.Attachment {
+		kind, _, _ := strings.Cut(a.MediaType, "/")
+		if kind != "image" && kind != "video" && kind != "audio" {
+			kind = "unknown"
+		}
+		s.MediaAttachments = append(s.MediaAttachments, mastodon.Attachment{
+			Type:        kind,
+			URL:         string(a.URL),
+			RemoteURL:   string(a.URL),
+			Description: a.Name,
+		})
+	}
+	for _, t := range n.Tag {
+		switch t.Type {
+		case "Hashtag":
+			s.Tags = append(s.Tags, mastodon.Tag{Name: strings.TrimPrefix(t.Name, "#"), URL: t.Href})
+		case "Mention":
+			acct := strings.TrimPrefix(t.Name, "@")
+			username, _, _ := strings.Cut(acct, "@")
+			s.Mentions = append(s.Mentions, mastodon.Mention{URL: t.Href, Username: username, Acct: acct})
+		}
+	}
+	return Status{Status: s}
+}
+
+// visibility works out the mastodon visibility from who a post was
+// addressed to
+func (o *Outbox) visibility(to, cc audience) string {
+	switch {
+	case to.hasAny(publicAudience...):
+		return mastodon.VisibilityPublic
+	case cc.hasAny(publicAudience...):
+		return mastodon.VisibilityUnlisted
+	case o.Actor.Followers != "" && to.hasAny(o.Actor.Followers):
+		return mastodon.VisibilityFollowersOnly
+	}
+	return mastodon.VisibilityDirectMessage
+}
+
+// object decodes an object that may be embedded or just its ID
+func (o *Outbox) object(ctx context.Context, raw json.RawMessage, out any) error {
+	var uri string
+	if json.Unmarshal(raw, &uri) != nil {
+		return json.Unmarshal(raw, out)
+	}
+	if _, err := o.get(ctx, uri, out); err != nil {
+		return fmt.Errorf("getting %s: %w", uri, err)
+	}
+	return nil
+}
+
+func (o *Outbox) get(ctx context.Context, uri string, out any) (RateLimit, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return RateLimit{}, err
+	}
+	req.Header.Set("Accept", activityJSON)
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return RateLimit{}, networkError(err)
+	}
+	defer resp.Body.Close()
+
+	limit, _ := parseRateLimit(resp.Header)
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		// servers in secure mode only answer signed requests, there's no
+		// token to expire
+		return limit, &remote.Error{Service: service, Kind: remote.InvalidRequest, StatusCode: resp.StatusCode, Err: errors.New("server requires signed requests")}
+	case resp.StatusCode != http.StatusOK:
+		return limit, statusError(resp, uri)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return limit, fmt.Errorf("decoding response from %s: %w", uri, err)
+	}
+	return limit, nil
+}
+
+// audience is a to or cc field, which can be one ID or a list of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if json.Unmarshal(data, &one) == nil {
+		*a = audience{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (a audience) hasAny(ids ...string) bool {
+	for _, item := range a {
+		for _, id := range ids {
+			if item == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// link is a url field, which can be a URL, a Link object or a list of
+// them.  Only the first is kept.
+type link string
+
+func (l *link) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*l = link(s)
+		return nil
+	}
+	var obj struct {
+		Href string `json:"href"`
+	}
+	if json.Unmarshal(data, &obj) == nil {
+		*l = link(obj.Href)
+		return nil
+	}
+	var list []link
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	if len(list) > 0 {
+		*l = list[0]
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package mastodon_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	gomastodon "github.com/mattn/go-mastodon"
+	"github.com/willgorman/mastodon-bsky/pkg/mastodon"
+	"gotest.tools/assert"
+)
+
+// newFakeOutbox serves the recorded outbox fixtures with example.com
+// replaced by the test server
+func newFakeOutbox(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	fixture := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			data, err := os.ReadFile("testdata/outbox/" + name)
+			if err != nil {
+				t.Error(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/activity+json")
+			w.Write([]byte(strings.ReplaceAll(string(data), "https://example.com", server.URL)))
+		}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/webfinger", func(w http.ResponseWriter, r *http.Request) {
+		u, _ := url.Parse(server.URL)
+		if r.URL.Query().Get("resource") != "acct:me@"+u.Host {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fixture("webfinger.json")(w, r)
+	})
+	mux.HandleFunc("/users/me", fixture("actor.json"))
+	mux.HandleFunc("/users/me/outbox", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Query().Get("max_id") == "111795667004443603":
+			fixture("outbox_page2.json")(w, r)
+		case r.URL.Query().Get("page") == "true":
+			fixture("outbox_page1.json")(w, r)
+		default:
+			fixture("outbox.json")(w, r)
+		}
+	})
+	mux.HandleFunc("/users/me/statuses/111795667004443603", fixture("status_111795667004443603.json"))
+	server = httptest.NewTLSServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestOutbox(t *testing.T) {
+	server := newFakeOutbox(t)
+	u, _ := url.Parse(server.URL)
+	ctx := context.Background()
+
+	outbox, err := mastodon.NewOutbox(ctx, server.Client(), "@me@"+u.Host)
+	assert.NilError(t, err)
+	assert.Equal(t, outbox.Actor.ID, server.URL+"/users/me")
+	account := outbox.Account()
+	assert.Equal(t, account.Acct, "me@"+u.Host)
+	assert.Equal(t, account.DisplayName, "Me Myself")
+	assert.Equal(t, account.URL, server.URL+"/@me")
+
+	// without min_id it's just the newest page, without the boost
+	statuses, _, err := outbox.Statuses(ctx, url.Values{})
+	assert.NilError(t, err)
+	assert.Equal(t, len(statuses), 2)
+
+	reply := statuses[0]
+	assert.Equal(t, reply.InReplyToID, "https://other.example/users/them/statuses/9")
+	assert.Equal(t, reply.Visibility, gomastodon.VisibilityUnlisted)
+	assert.Equal(t, reply.Language, "en")
+	assert.DeepEqual(t, reply.Mentions, []gomastodon.Mention{{
+		URL:      "https://other.example/users/them",
+		Username: "them",
+		Acct:     "them@other.example",
+	}})
+	assert.Equal(t, reply.CreatedAt, time.Date(2024, 1, 20, 11, 4, 0, 0, time.UTC))
+
+	byRef := statuses[1]
+	assert.Equal(t, string(byRef.ID), server.URL+"/users/me/statuses/111795667004443603")
+	assert.Equal(t, byRef.URL, server.URL+"/@me/111795667004443603")
+	assert.Equal(t, byRef.Content, "<p>post by reference</p>")
+	assert.Equal(t, byRef.InReplyToID, nil)
+	assert.Equal(t, byRef.Account.Acct, "me@"+u.Host)
+
+	// with min_id it pages back until it finds it
+	statuses, _, err = outbox.Statuses(ctx, url.Values{"min_id": {server.URL + "/users/me/statuses/111795667004443601"}})
+	assert.NilError(t, err)
+	assert.Equal(t, len(statuses), 3)
+
+	media := statuses[2]
+	assert.Equal(t, media.SpoilerText, "birds")
+	assert.Assert(t, media.Sensitive)
+	assert.Equal(t, media.Language, "de")
+	assert.DeepEqual(t, media.Tags, []gomastodon.Tag{{Name: "Birds", URL: server.URL + "/tags/birds"}})
+	assert.DeepEqual(t, media.MediaAttachments, []gomastodon.Attachment{{
+		Type:        "image",
+		URL:         server.URL + "/system/media_attachments/files/bird.jpg",
+		RemoteURL:   server.URL + "/system/media_attachments/files/bird.jpg",
+		Description: "a small brown bird",
+	}})
+}
+
+func TestOutboxCheckpoint(t *testing.T) {
+	server := newFakeOutbox(t)
+	ctx := context.Background()
+	outbox, err := mastodon.NewOutbox(ctx, server.Client(), server.URL+"/users/me")
+	assert.NilError(t, err)
+
+	// a boost can still be the checkpoint from when they were sent
+	statuses, _, err := outbox.Statuses(ctx, url.Values{"min_id": {server.URL + "/users/me/statuses/111795667004443605/activity"}})
+	assert.NilError(t, err)
+	assert.Equal(t, len(statuses), 0)
+
+	// a checkpoint that isn't there doesn't make everything new
+	statuses, _, err = outbox.Statuses(ctx, url.Values{"min_id": {server.URL + "/users/me/statuses/1"}})
+	assert.Assert(t, errors.Is(err, mastodon.ErrCheckpointNotFound), "got %v", err)
+	assert.Equal(t, len(statuses), 0)
+}
+
+func TestOutboxActorURL(t *testing.T) {
+	server := newFakeOutbox(t)
+	outbox, err := mastodon.NewOutbox(context.Background(), server.Client(), server.URL+"/users/me")
+	assert.NilError(t, err)
+	assert.Equal(t, outbox.Actor.Followers, server.URL+"/users/me/followers")
+}
+
+func TestOutboxUnknownAccount(t *testing.T) {
+	server := newFakeOutbox(t)
+	u, _ := url.Parse(server.URL)
+	_, err := mastodon.NewOutbox(context.Background(), server.Client(), "@nobody@"+u.Host)
+	assert.ErrorContains(t, err, "looking up @nobody@")
+}
+
+func TestOutboxSource(t *testing.T) {
+	server := newFakeOutbox(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outbox, err := mastodon.NewOutbox(ctx, server.Client(), server.URL+"/users/me")
+	assert.NilError(t, err)
+
+	statuses := server.URL + "/users/me/statuses/"
+	toots, errs := mastodon.NewOutboxSource(outbox, statuses+"111795667004443601", time.Hour).Open(ctx)
+	assert.DeepEqual(t, receive(t, toots, errs, 3), []string{
+		statuses + "111795667004443602",
+		statuses + "111795667004443603",
+		statuses + "111795667004443604",
+	})
+}
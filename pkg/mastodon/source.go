@@ -2,68 +2,207 @@ package mastodon
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/mattn/go-mastodon"
+	"github.com/willgorman/mastodon-bsky/pkg/remote"
 )
 
+// timeline gets a page of statuses
+type timeline func(ctx context.Context, params url.Values) ([]Status, RateLimit, error)
+
 type source struct {
 	client   Client
-	filters  any
-	startID  string
-	interval time.Duration
-	statusCh chan Status
-	errorCh  chan error
+	timeline timeline
+	// checkMoved stops the source with a MovedError when the logged in
+	// account moves
+	checkMoved bool
+	// movedChecked is when the account was last checked for a move
+	movedChecked time.Time
+	filters      Filter
+	startID      string
+	interval     time.Duration
+	statusCh     chan Status
+	errorCh      chan error
+}
+
+// NewSource polls for the statuses of the logged in account
+func NewSource(client Client, startID string, interval time.Duration, filters Filter) *source {
+	return &source{
+		client:     client,
+		timeline:   client.AccountStatuses,
+		checkMoved: true,
+		filters:    filters,
+		startID:    startID,
+		interval:   interval,
+	}
+}
+
+// NewHashtagSource polls for public statuses with the hashtag.  The
+// account statuses query parameters don't apply to it so filters are
+// only checked by the processor.
+func NewHashtagSource(client Client, tag string, startID string, interval time.Duration) *source {
+	return &source{
+		client: client,
+		timeline: func(ctx context.Context, params url.Values) ([]Status, RateLimit, error) {
+			return client.HashtagStatuses(ctx, tag, params)
+		},
+		startID:  startID,
+		interval: interval,
+	}
+}
+
+// NewListSource polls for statuses from the accounts in a list
+func NewListSource(client Client, listID string, startID string, interval time.Duration) *source {
+	return &source{
+		client: client,
+		timeline: func(ctx context.Context, params url.Values) ([]Status, RateLimit, error) {
+			return client.ListStatuses(ctx, listID, params)
+		},
+		startID:  startID,
+		interval: interval,
+	}
 }
 
-// TODO: (willgorman) define filters
-func NewSource(client Client, startID string, interval time.Duration, filters any) *source {
+// NewOutboxSource polls the outbox of an account we don't log in to.  The
+// status IDs are the ActivityPub IDs of the posts.
+func NewOutboxSource(outbox *Outbox, startID string, interval time.Duration) *source {
 	return &source{
-		client:  client,
-		filters: filters,
+		timeline: outbox.Statuses,
+		startID:  startID,
+		interval: interval,
 	}
 }
 
+// pageLimit is the most statuses mastodon returns in a page
+const pageLimit = 40
+
+const defaultInterval = time.Minute
+
+// moveCheckInterval is how often the account is checked for a move while
+// polling works.  Moves are rare and it costs a request against the rate
+// limit.
+const moveCheckInterval = time.Hour
+
 func (s *source) Open(ctx context.Context) (<-chan Status, <-chan error) {
-	// FIXME: (willgorman) impl
 	s.statusCh = make(chan Status)
 	s.errorCh = make(chan error)
+	if s.interval <= 0 {
+		s.interval = defaultInterval
+	}
 	go s.streamStatus(ctx)
 
 	return s.statusCh, s.errorCh
 }
 
+// streamStatus polls for new statuses every interval and sends them
+// oldest first.  The channels are closed when ctx is done, or after a
+// MovedError is sent.
 func (s *source) streamStatus(ctx context.Context) {
-	var statuses []*mastodon.Status
-	var err error
+	defer close(s.errorCh)
+	defer close(s.statusCh)
 	tick := time.NewTicker(s.interval)
 	defer tick.Stop()
 	for {
+		err := s.movedAfter(ctx, s.poll(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case s.errorCh <- err:
+			case <-ctx.Done():
+				return
+			}
+			var moved *MovedError
+			if errors.As(err, &moved) {
+				return
+			}
+		}
 		select {
 		case <-ctx.Done():
-			close(s.errorCh)
-			close(s.statusCh)
 			return
 		case <-tick.C:
-			if len(statuses) == 0 {
-				statuses, err = s.client.GetAccountStatuses(context.Background(), s.client.user.ID, &mastodon.Pagination{
-					SinceID: mastodon.ID(s.startID),
-				})
-				if err != nil {
-					s.errorCh <- err
-				}
+		}
+	}
+}
+
+// poll pages forward from startID with min_id until it gets an empty page.  Mastodon returns the page immediately after min_id newest
+// first, so each page is sent in reverse.
+func (s *source) poll(ctx context.Context) error {
+	for {
+		params := s.filters.Params()
+		params.Set("limit", strconv.Itoa(pageLimit))
+		if s.startID != "" {
+			params.Set("min_id", s.startID)
+		}
+		statuses, limit, err := s.timeline(ctx, params)
+		if errors.Is(err, ErrRateLimited) && limit.Exhausted(time.Now()) {
+			if err := waitUntil(ctx, limit.Reset); err != nil {
+				return err
 			}
-			for _, status := range statuses {
-				select {
-				case <-ctx.Done():
-					close(s.statusCh)
-					close(s.errorCh)
-					return
-				case s.statusCh <- Status(*status):
-				}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(statuses) == 0 {
+			return nil
+		}
+		for i := len(statuses) - 1; i >= 0; i-- {
+			select {
+			case s.statusCh <- statuses[i]:
+				s.startID = string(statuses[i].ID)
+			case <-ctx.Done():
+				return ctx.Err()
 			}
-			s.startID = string(statuses[len(statuses)-1].ID)
 		}
+		if limit.Exhausted(time.Now()) {
+			if err := waitUntil(ctx, limit.Reset); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// movedAfter checks whether the account has moved after polling ended with
+// err.  It's checked every moveCheckInterval, or straight away if err is how
+// the server answers for an account that has moved.  A MovedError takes the
+// place of err.
+func (s *source) movedAfter(ctx context.Context, err error) error {
+	if !s.checkMoved {
+		return err
+	}
+	var rerr *remote.Error
+	gone := errors.As(err, &rerr) &&
+		(rerr.StatusCode == http.StatusUnauthorized || rerr.StatusCode == http.StatusGone)
+	if err != nil && !gone {
+		return err
+	}
+	if !gone && time.Since(s.movedChecked) < moveCheckInterval {
+		return nil
+	}
+	s.movedChecked = time.Now()
+	merr := s.client.CheckMoved(ctx)
+	var moved *MovedError
+	if err == nil || errors.As(merr, &moved) {
+		return merr
+	}
+	return err
+}
+
+func waitUntil(ctx context.Context, t time.Time) error {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
@@ -77,7 +216,7 @@ func NewFakeSource() *fakeSource {
 }
 
 func (f *fakeSource) makeStatus() Status {
-	exampleNewlines := &Status{
+	exampleNewlines := &mastodon.Status{
 		ID:  "111795667004443647",
 		URI: "https://example.com/users/me/statuses/111795667004443647",
 		URL: "https://example.com/@me/111795667004443647",
@@ -135,7 +274,7 @@ func (f *fakeSource) makeStatus() Status {
 		Language: "en",
 		Pinned:   false,
 	}
-	return *exampleNewlines
+	return Status{Status: *exampleNewlines}
 }
 
 func (f *fakeSource) Open(ctx context.Context) (<-chan Status, <-chan error) {
@@ -0,0 +1,438 @@
+package mastodon_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gomastodon "github.com/mattn/go-mastodon"
+	"github.com/willgorman/mastodon-bsky/pkg/mastodon"
+	"gotest.tools/assert"
+)
+
+type fakeStatus struct {
+	gomastodon.Status
+	Application struct {
+		Name string `json:"name"`
+	} `json:"application"`
+}
+
+// fakeMastodon is just enough of the mastodon API for a source
+type fakeMastodon struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []fakeStatus
+	requests []url.Values
+	// rateLimited is how many requests get a 429 before succeeding
+	rateLimited int
+	reset       time.Time
+	// streams are the events sent on each connection to the user stream
+	streams chan []string
+	// quiet keeps streams open after their events, without heartbeats
+	quiet bool
+	// sources are the plain text of statuses by ID
+	sources map[string]string
+	// moved is the account we've moved to
+	moved *gomastodon.Account
+	// gone answers 410 for statuses, like for an account that has moved
+	gone bool
+	// verified counts the requests for the logged in account
+	verified int
+}
+
+func newFakeMastodon(t *testing.T) *fakeMastodon {
+	f := &fakeMastodon{streams: make(chan []string, 10), sources: map[string]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "token"})
+	})
+	mux.HandleFunc("/api/v1/accounts/verify_credentials", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.verified++
+		json.NewEncoder(w).Encode(gomastodon.Account{ID: "1", Username: "me", Acct: "me", URL: f.URL + "/@me", Moved: f.moved})
+	})
+	mux.HandleFunc("/api/v1/accounts/1/statuses", f.accountStatuses)
+	mux.HandleFunc("/api/v1/timelines/tag/bsky", f.accountStatuses)
+	mux.HandleFunc("/api/v1/timelines/list/7", f.accountStatuses)
+	mux.HandleFunc("/api/v1/streaming/user", f.streamUser)
+	mux.HandleFunc("/api/v1/statuses/", f.statusSource)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeMastodon) addStatuses(from, to int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := from; i <= to; i++ {
+		s := fakeStatus{Status: gomastodon.Status{
+			ID:         gomastodon.ID(strconv.Itoa(i)),
+			Content:    fmt.Sprintf("<p>toot %d</p>", i),
+			Visibility: gomastodon.VisibilityPublic,
+			Account:    gomastodon.Account{ID: "1", Acct: "me"},
+		}}
+		s.Application.Name = "Web"
+		f.statuses = append(f.statuses, s)
+	}
+}
+
+func (f *fakeMastodon) accountStatuses(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.requests = append(f.requests, r.URL.Query())
+	if f.gone {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	if f.rateLimited > 0 {
+		f.rateLimited--
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", f.reset.UTC().Format(time.RFC3339Nano))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit == 0 {
+		limit = 20
+	}
+	minID, _ := strconv.Atoi(r.URL.Query().Get("min_id"))
+	var page []fakeStatus
+	for _, s := range f.statuses {
+		id, _ := strconv.Atoi(string(s.ID))
+		if id > minID {
+			page = append(page, s)
+		}
+	}
+	if minID > 0 && len(page) > limit {
+		page = page[:limit]
+	}
+	if minID == 0 && len(page) > limit {
+		page = page[len(page)-limit:]
+	}
+	sort.Slice(page, func(i, j int) bool {
+		a, _ := strconv.Atoi(string(page[i].ID))
+		b, _ := strconv.Atoi(string(page[j].ID))
+		return a > b
+	})
+	w.Header().Set("X-RateLimit-Remaining", "299")
+	w.Header().Set("X-RateLimit-Reset", time.Now().Add(5*time.Minute).UTC().Format(time.RFC3339Nano))
+	json.NewEncoder(w).Encode(page)
+}
+
+func (f *fakeMastodon) statusSource(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/statuses/"), "/source")
+	text, ok := f.sources[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id": id, "text": text, "spoiler_text": ""})
+}
+
+// streamUser sends the next script of events and then disconnects
+func (f *fakeMastodon) streamUser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	select {
+	case script := <-f.streams:
+		for _, line := range script {
+			fmt.Fprintln(w, line)
+		}
+		w.(http.Flusher).Flush()
+	case <-r.Context().Done():
+	}
+	f.mu.Lock()
+	quiet := f.quiet
+	f.mu.Unlock()
+	if quiet {
+		<-r.Context().Done()
+	}
+}
+
+func (f *fakeMastodon) client(t *testing.T) *mastodon.Client {
+	return f.clientWithConfig(t, mastodon.Config{})
+}
+
+func (f *fakeMastodon) clientWithConfig(t *testing.T, cfg mastodon.Config) *mastodon.Client {
+	cfg.Server, cfg.Username, cfg.Password = f.URL, "me", "pw"
+	c, err := mastodon.NewClient(context.Background(), cfg)
+	assert.NilError(t, err)
+	return c
+}
+
+func receive(t *testing.T, toots <-chan mastodon.Status, errs <-chan error, n int) []string {
+	t.Helper()
+	var ids []string
+	timeout := time.After(5 * time.Second)
+	for len(ids) < n {
+		select {
+		case toot := <-toots:
+			ids = append(ids, string(toot.ID))
+		case err := <-errs:
+			t.Fatalf("unexpected error: %s", err)
+		case <-timeout:
+			t.Fatalf("timed out after %d toots", len(ids))
+		}
+	}
+	return ids
+}
+
+func idRange(from, to int) []string {
+	var ids []string
+	for i := from; i <= to; i++ {
+		ids = append(ids, strconv.Itoa(i))
+	}
+	return ids
+}
+
+func TestSourcePagesOldestFirst(t *testing.T) {
+	server := newFakeMastodon(t)
+	server.addStatuses(1, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := mastodon.NewSource(*server.client(t), "10", time.Hour, mastodon.Filter{})
+	toots, errs := source.Open(ctx)
+	assert.DeepEqual(t, receive(t, toots, errs, 90), idRange(11, 100))
+
+	cancel()
+	_, ok := <-toots
+	assert.Assert(t, !ok)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	var minIDs []string
+	for _, r := range server.requests {
+		minIDs = append(minIDs, r.Get("min_id"))
+	}
+	assert.DeepEqual(t, minIDs[:3], []string{"10", "50", "90"})
+}
+
+func TestSourceDecodesApplication(t *testing.T) {
+	server := newFakeMastodon(t)
+	server.addStatuses(1, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	toots, errs := mastodon.NewSource(*server.client(t), "", time.Hour, mastodon.Filter{}).Open(ctx)
+	select {
+	case toot := <-toots:
+		assert.Equal(t, toot.ApplicationName, "Web")
+	case err := <-errs:
+		t.Fatal(err)
+	}
+}
+
+func TestSourceEmptyThenNew(t *testing.T) {
+	server := newFakeMastodon(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	toots, errs := mastodon.NewSource(*server.client(t), "", 10*time.Millisecond, mastodon.Filter{}).Open(ctx)
+	time.Sleep(30 * time.Millisecond)
+	server.addStatuses(1, 3)
+	assert.DeepEqual(t, receive(t, toots, errs, 3), idRange(1, 3))
+	server.addStatuses(4, 5)
+	assert.DeepEqual(t, receive(t, toots, errs, 2), idRange(4, 5))
+}
+
+func TestSourceRateLimit(t *testing.T) {
+	server := newFakeMastodon(t)
+	server.addStatuses(1, 2)
+	server.rateLimited = 1
+	server.reset = time.Now().Add(200 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start := time.Now()
+	toots, errs := mastodon.NewSource(*server.client(t), "", time.Hour, mastodon.Filter{}).Open(ctx)
+	assert.DeepEqual(t, receive(t, toots, errs, 2), idRange(1, 2))
+	assert.Assert(t, time.Since(start) >= 150*time.Millisecond)
+}
+
+func TestSourceRateLimitCancel(t *testing.T) {
+	server := newFakeMastodon(t)
+	server.addStatuses(1, 2)
+	server.rateLimited = 1
+	server.reset = time.Now().Add(time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	toots, _ := mastodon.NewSource(*server.client(t), "", time.Hour, mastodon.Filter{}).Open(ctx)
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case _, ok := <-toots:
+		assert.Assert(t, !ok)
+	case <-time.After(time.Second):
+		t.Fatal("source didn't stop waiting for the rate limit")
+	}
+}
+
+func TestSourceSendsFilterParams(t *testing.T) {
+	server := newFakeMastodon(t)
+	server.addStatuses(1, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	filter := mastodon.Filter{
+		Include: []mastodon.Rule{{HasMedia: boolp(true)}},
+		Exclude: []mastodon.Rule{{Reply: boolp(true)}, {Languages: []string{"de"}}},
+	}
+	toots, errs := mastodon.NewSource(*server.client(t), "", time.Hour, filter).Open(ctx)
+	receive(t, toots, errs, 1)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	assert.DeepEqual(t, server.requests[0], url.Values{
+		"limit":           {"40"},
+		"only_media":      {"true"},
+		"exclude_replies": {"true"},
+	})
+}
+
+type statusSource interface {
+	Open(context.Context) (<-chan mastodon.Status, <-chan error)
+}
+
+func TestTimelineSources(t *testing.T) {
+	tests := []struct {
+		name   string
+		source func(c mastodon.Client) statusSource
+	}{
+		{
+			name: "hashtag",
+			source: func(c mastodon.Client) statusSource {
+				return mastodon.NewHashtagSource(c, "#bsky", "2", time.Hour)
+			},
+		},
+		{
+			name: "list",
+			source: func(c mastodon.Client) statusSource {
+				return mastodon.NewListSource(c, "7", "2", time.Hour)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeMastodon(t)
+			server.addStatuses(1, 5)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			toots, errs := tt.source(*server.client(t)).Open(ctx)
+			assert.DeepEqual(t, receive(t, toots, errs, 3), idRange(3, 5))
+		})
+	}
+}
+
+func TestSourcePlainText(t *testing.T) {
+	server := newFakeMastodon(t)
+	server.addStatuses(1, 2)
+	server.sources["1"] = "toot *1* https://example.com/a/long/link"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, plainText := range []bool{true, false} {
+		client := server.clientWithConfig(t, mastodon.Config{PlainText: plainText})
+		toots, errs := mastodon.NewSource(*client, "", time.Hour, mastodon.Filter{}).Open(ctx)
+		var texts []string
+		for len(texts) < 2 {
+			select {
+			case toot := <-toots:
+				texts = append(texts, toot.Text)
+			case err := <-errs:
+				t.Fatal(err)
+			}
+		}
+		if plainText {
+			// status 2 has no source so it falls back to the content
+			assert.DeepEqual(t, texts, []string{"toot *1* https://example.com/a/long/link", ""})
+		} else {
+			assert.DeepEqual(t, texts, []string{"", ""})
+		}
+	}
+}
+
+func TestSourceMoved(t *testing.T) {
+	server := newFakeMastodon(t)
+	server.addStatuses(1, 2)
+	client := server.client(t)
+	server.mu.Lock()
+	server.moved = &gomastodon.Account{ID: "9", Acct: "me@new.example", URL: "https://new.example/@me"}
+	server.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	toots, errs := mastodon.NewSource(*client, "", 10*time.Millisecond, mastodon.Filter{}).Open(ctx)
+	// statuses from before the move are still sent
+	assert.DeepEqual(t, receive(t, toots, errs, 2), idRange(1, 2))
+	err := <-errs
+	var moved *mastodon.MovedError
+	assert.Assert(t, errors.As(err, &moved), err)
+	assert.Equal(t, moved.MovedTo.URL, "https://new.example/@me")
+	assert.ErrorContains(t, err, "has moved to https://new.example/@me")
+
+	// and the source stops
+	_, ok := <-toots
+	assert.Assert(t, !ok)
+}
+
+func TestSourceChecksMovedHourly(t *testing.T) {
+	server := newFakeMastodon(t)
+	server.addStatuses(1, 2)
+	client := server.client(t)
+	server.mu.Lock()
+	verified := server.verified
+	server.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	toots, errs := mastodon.NewSource(*client, "", 10*time.Millisecond, mastodon.Filter{}).Open(ctx)
+	assert.DeepEqual(t, receive(t, toots, errs, 2), idRange(1, 2))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		server.mu.Lock()
+		polls := len(server.requests)
+		server.mu.Unlock()
+		if polls >= 10 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only polled %d times", polls)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// only the first poll checked
+	server.mu.Lock()
+	assert.Equal(t, server.verified-verified, 1)
+
+	// until the statuses are gone, which is checked straight away
+	server.moved = &gomastodon.Account{ID: "9", Acct: "me@new.example", URL: "https://new.example/@me"}
+	server.gone = true
+	server.mu.Unlock()
+	var moved *mastodon.MovedError
+	select {
+	case err := <-errs:
+		assert.Assert(t, errors.As(err, &moved), err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("move wasn't noticed")
+	}
+}
@@ -0,0 +1,217 @@
+package mastodon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	"github.com/willgorman/mastodon-bsky/pkg/remote"
+)
+
+// streamSource sends statuses from the user streaming API as they're
+// posted, edited and deleted.  go-mastodon's StreamingUser, and its
+// websocket version, drop status.update events and reconnect in a loop
+// without telling the caller, so this reads the event stream itself.
+// Mastodon doesn't give events IDs to resume from with Last-Event-ID, so
+// whatever was missed while disconnected is backfilled with the polling
+// source.
+type streamSource struct {
+	client   Client
+	backfill *source
+	retry    time.Duration
+	// idle is how long the stream can go without an event or heartbeat
+	// before it's taken to be dead and reconnected
+	idle time.Duration
+}
+
+const defaultRetry = 5 * time.Second
+
+// defaultIdle is a few of the heartbeats mastodon sends while there
+// aren't any events
+const defaultIdle = time.Minute
+
+func NewStreamSource(client Client, startID string, retry, idle time.Duration, filters Filter) *streamSource {
+	if retry <= 0 {
+		retry = defaultRetry
+	}
+	if idle <= 0 {
+		idle = defaultIdle
+	}
+	return &streamSource{
+		client:   client,
+		backfill: NewSource(client, startID, 0, filters),
+		retry:    retry,
+		idle:     idle,
+	}
+}
+
+func (s *streamSource) Open(ctx context.Context) (<-chan Status, <-chan error) {
+	s.backfill.statusCh = make(chan Status)
+	s.backfill.errorCh = make(chan error)
+	go s.run(ctx)
+
+	return s.backfill.statusCh, s.backfill.errorCh
+}
+
+func (s *streamSource) run(ctx context.Context) {
+	defer close(s.backfill.errorCh)
+	defer close(s.backfill.statusCh)
+	for {
+		err := s.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			select {
+			case s.backfill.errorCh <- err:
+			case <-ctx.Done():
+				return
+			}
+			var moved *MovedError
+			if errors.As(err, &moved) {
+				return
+			}
+		}
+		if waitUntil(ctx, time.Now().Add(s.retry)) != nil {
+			return
+		}
+	}
+}
+
+// stream connects to the user stream, backfills through the timeline
+// and then sends events until the connection drops.  Connecting before
+// backfilling means nothing posted in between is missed, and updates
+// the backfill already sent are dropped.
+func (s *streamSource) stream(ctx context.Context) error {
+	u, err := url.Parse(s.client.Config.Server)
+	if err != nil {
+		return err
+	}
+	u = u.JoinPath("/api/v1/streaming/user")
+	connCtx, disconnect := context.WithCancel(ctx)
+	defer disconnect()
+	req, err := http.NewRequestWithContext(connCtx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.client.Config.AccessToken)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("connecting to stream: %w", networkError(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("connecting to stream: %w", s.backfill.movedAfter(ctx, statusError(resp, u.Path)))
+	}
+
+	// nothing in the stream says when the account moves so it's only
+	// checked when reconnecting
+	if err := s.backfill.movedAfter(ctx, s.backfill.poll(ctx)); err != nil {
+		return fmt.Errorf("backfilling: %w", err)
+	}
+
+	// a connection that has stopped sending heartbeats is dropped
+	idle := time.AfterFunc(s.idle, disconnect)
+	defer idle.Stop()
+	var event string
+	var data []string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		idle.Reset(s.idle)
+		line := scanner.Text()
+		if line == "" {
+			// a blank line ends an event
+			if len(data) > 0 {
+				if err := s.send(ctx, event, strings.Join(data, "\n")); err != nil {
+					return err
+				}
+			}
+			event, data = "", nil
+			continue
+		}
+		// lines starting with : are heartbeats, and id and retry aren't
+		// used by mastodon
+		name, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch name {
+		case "event":
+			event = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+	if ctx.Err() == nil && connCtx.Err() != nil {
+		return &remote.Error{Service: service, Kind: remote.Network, Err: fmt.Errorf("no events or heartbeats from %s for %s", u.Path, s.idle)}
+	}
+	// the connection dropping is a network error like any other
+	return networkError(scanner.Err())
+}
+
+// send sends the status for an event if it's one of ours
+func (s *streamSource) send(ctx context.Context, event, data string) error {
+	status, ok, err := s.parse(event, data)
+	if err != nil {
+		return fmt.Errorf("parsing %s event: %w", event, err)
+	}
+	if !ok {
+		return nil
+	}
+	if status.Event != EventDelete {
+		if _, err := s.client.addText(ctx, &status); err != nil {
+			return err
+		}
+	}
+	select {
+	case s.backfill.statusCh <- status:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if status.Event == EventUpdate {
+		s.backfill.startID = string(status.ID)
+	}
+	return nil
+}
+
+// parse returns the status for an event, or false if it isn't an event
+// for one of our statuses that hasn't been sent yet.
+func (s *streamSource) parse(event, data string) (Status, bool, error) {
+	switch event {
+	case EventUpdate, EventEdit:
+		var status Status
+		if err := json.Unmarshal([]byte(data), &status); err != nil {
+			return Status{}, false, err
+		}
+		// the user stream is the home timeline so it has everyone we follow
+		if status.Account.ID != s.client.user.ID {
+			return Status{}, false, nil
+		}
+		if event == EventUpdate && !newerID(string(status.ID), s.backfill.startID) {
+			return Status{}, false, nil
+		}
+		status.Event = event
+		return status, true, nil
+	case EventDelete:
+		// deletes don't say whose status it was, that's up to the processor
+		status := Status{Event: EventDelete}
+		status.ID = mastodon.ID(strings.TrimSpace(data))
+		return status, true, nil
+	}
+	return Status{}, false, nil
+}
+
+// newerID compares mastodon IDs, which are numeric strings
+func newerID(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
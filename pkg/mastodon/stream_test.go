@@ -0,0 +1,109 @@
+package mastodon_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	gomastodon "github.com/mattn/go-mastodon"
+	"github.com/willgorman/mastodon-bsky/pkg/mastodon"
+	"github.com/willgorman/mastodon-bsky/pkg/remote"
+	"gotest.tools/assert"
+)
+
+func streamEvent(t *testing.T, event string, id, accountID string) []string {
+	data, err := json.Marshal(gomastodon.Status{
+		ID:      gomastodon.ID(id),
+		Account: gomastodon.Account{ID: gomastodon.ID(accountID)},
+		Content: "<p>streamed</p>",
+	})
+	assert.NilError(t, err)
+	return []string{"event: " + event, "data: " + string(data), ""}
+}
+
+func TestStreamSource(t *testing.T) {
+	server := newFakeMastodon(t)
+	server.addStatuses(1, 3)
+	var script []string
+	script = append(script, streamEvent(t, "update", "4", "1")...)
+	// someone we follow
+	script = append(script, streamEvent(t, "update", "50", "2")...)
+	// already sent by the backfill
+	script = append(script, streamEvent(t, "update", "3", "1")...)
+	script = append(script, ":thump", "")
+	script = append(script, streamEvent(t, "status.update", "2", "1")...)
+	script = append(script, "event: delete", "data: 3", "")
+	server.streams <- script
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	toots, errs := mastodon.NewStreamSource(*server.client(t), "1", 10*time.Millisecond, 0, mastodon.Filter{}).Open(ctx)
+
+	type event struct {
+		id    string
+		event string
+	}
+	next := func() event {
+		t.Helper()
+		select {
+		case toot := <-toots:
+			return event{string(toot.ID), toot.Event}
+		case err := <-errs:
+			t.Fatalf("unexpected error: %s", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out")
+		}
+		return event{}
+	}
+
+	// backfill then the stream
+	assert.Equal(t, next(), event{"2", ""})
+	assert.Equal(t, next(), event{"3", ""})
+	assert.Equal(t, next(), event{"4", mastodon.EventUpdate})
+	assert.Equal(t, next(), event{"2", mastodon.EventEdit})
+	assert.Equal(t, next(), event{"3", mastodon.EventDelete})
+
+	// posted while disconnected, picked up by the backfill on reconnect
+	server.addStatuses(5, 5)
+	assert.Equal(t, next(), event{"5", ""})
+
+	cancel()
+	for range toots {
+	}
+}
+
+func TestStreamSourceIdle(t *testing.T) {
+	server := newFakeMastodon(t)
+	server.addStatuses(1, 1)
+	// an event can be split over data lines
+	data, err := json.MarshalIndent(gomastodon.Status{ID: "2", Account: gomastodon.Account{ID: "1"}}, "", "  ")
+	assert.NilError(t, err)
+	script := []string{"event: update"}
+	for _, line := range strings.Split(string(data), "\n") {
+		script = append(script, "data: "+line)
+	}
+	server.streams <- append(script, "")
+	// and then the connection goes quiet without closing
+	server.quiet = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	toots, errs := mastodon.NewStreamSource(*server.client(t), "", 10*time.Millisecond, 50*time.Millisecond, mastodon.Filter{}).Open(ctx)
+	assert.DeepEqual(t, receive(t, toots, errs, 2), []string{"1", "2"})
+
+	server.addStatuses(3, 3)
+	select {
+	case err := <-errs:
+		var rerr *remote.Error
+		assert.Assert(t, errors.As(err, &rerr), err)
+		assert.Equal(t, rerr.Kind, remote.Network)
+		assert.ErrorContains(t, err, "no events or heartbeats")
+	case <-time.After(5 * time.Second):
+		t.Fatal("quiet stream wasn't dropped")
+	}
+	// reconnecting backfills what was missed
+	assert.DeepEqual(t, receive(t, toots, errs, 1), []string{"3"})
+}
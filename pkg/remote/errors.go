@@ -0,0 +1,111 @@
+// Package remote is how the clients of the servers toots are crossposted
+// between report what went wrong, so the errors of both can be handled the
+// same way.
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Kind is what went wrong talking to a server
+type Kind int
+
+const (
+	// Network errors didn't get a response from the server
+	Network Kind = iota + 1
+	// AuthExpired means the credentials aren't accepted any more
+	AuthExpired
+	// RateLimited requests can be made again at RetryAfter
+	RateLimited
+	// InvalidRequest means the server won't accept the request as it is
+	InvalidRequest
+	// NotFound means what was asked for doesn't exist, or was deleted
+	NotFound
+	// Upstream errors are 5xx responses
+	Upstream
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Network:
+		return "network error"
+	case AuthExpired:
+		return "auth expired"
+	case RateLimited:
+		return "rate limited"
+	case InvalidRequest:
+		return "invalid request"
+	case NotFound:
+		return "not found"
+	case Upstream:
+		return "upstream error"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// ErrRateLimited matches an Error that's RateLimited
+var ErrRateLimited = errors.New("rate limited")
+
+// Error is an error from a client with the kind of failure, so callers can
+// use errors.As to decide what to do about it
+type Error struct {
+	// Service is who the error came from, like "bluesky" or "mastodon"
+	Service string
+	Kind    Kind
+	// StatusCode of the response, 0 for network errors
+	StatusCode int
+	// RetryAfter is when a rate limit resets, if the server said
+	RetryAfter time.Time
+	Err        error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == ErrRateLimited && e.Kind == RateLimited
+}
+
+// Transient reports whether the request could work if it's made again
+// later without changing anything.  Request timeouts are invalid requests
+// that can be.
+func (e *Error) Transient() bool {
+	return e.Kind == Network || e.Kind == RateLimited || e.Kind == Upstream ||
+		e.StatusCode == http.StatusRequestTimeout
+}
+
+// NetworkError is the Error from service for an error making a request
+// that didn't get a response.  Anything else is returned as is.
+func NetworkError(service string, err error) error {
+	var uerr *url.Error
+	var nerr net.Error
+	if errors.As(err, &uerr) || errors.As(err, &nerr) {
+		return &Error{Service: service, Kind: Network, Err: err}
+	}
+	return err
+}
+
+// KindForStatus is the Kind of a response that wasn't successful
+func KindForStatus(status int) Kind {
+	switch {
+	case status == http.StatusUnauthorized:
+		return AuthExpired
+	case status == http.StatusTooManyRequests:
+		return RateLimited
+	case status == http.StatusNotFound || status == http.StatusGone:
+		return NotFound
+	case status >= 500:
+		return Upstream
+	}
+	return InvalidRequest
+}
@@ -0,0 +1,122 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/willgorman/mastodon-bsky/pkg/bsky"
+	"github.com/willgorman/mastodon-bsky/pkg/remote"
+)
+
+// Stage is how far an attempt at crossposting a toot got
+type Stage string
+
+const (
+	// StageFetch is getting the images of the toot from its server
+	StageFetch Stage = "fetch"
+	// StageConvert is translating the toot to a post
+	StageConvert Stage = "convert"
+	// StageUpload is sending the images to bluesky
+	StageUpload Stage = "upload"
+	// StagePost is creating the post
+	StagePost Stage = "post"
+)
+
+// Attempt is the history of one try at crossposting a toot
+type Attempt struct {
+	ID           int64  `db:"id"`
+	SourcePostID string `db:"source_post_id"`
+	// Attempt is the number of the attempt, from the record's Attempts
+	Attempt   int       `db:"attempt"`
+	StartedAt time.Time `db:"started_at"`
+	// Stage is where the attempt failed, or StagePost if it didn't
+	Stage    Stage         `db:"stage"`
+	Duration time.Duration `db:"duration"`
+	// ErrorClass is the kind of error, see errorClass
+	ErrorClass    string `db:"error_class"`
+	Error         string `db:"error"`
+	TargetPostURI string `db:"target_post_uri"`
+	TargetPostCID string `db:"target_post_cid"`
+}
+
+// Failed reports whether the attempt ended with an error
+func (a Attempt) Failed() bool {
+	return a.Error != ""
+}
+
+// AddAttempt saves the history of an attempt
+func (d *Datastore) AddAttempt(ctx context.Context, attempt Attempt) error {
+	attempt.StartedAt = attempt.StartedAt.UTC()
+	_, err := d.db.NamedExecContext(ctx,
+		`INSERT INTO sync_attempt (source_post_id, attempt, started_at, stage, duration, error_class, error, target_post_uri, target_post_cid)
+			VALUES (:source_post_id, :attempt, :started_at, :stage, :duration, :error_class, :error, :target_post_uri, :target_post_cid)
+		`, &attempt)
+	if err != nil {
+		return fmt.Errorf("unable to add attempt for %s: %w", attempt.SourcePostID, err)
+	}
+	return nil
+}
+
+// ListAttempts returns the attempts at crossposting a toot, oldest first
+func (d *Datastore) ListAttempts(ctx context.Context, sourcePostID string) ([]Attempt, error) {
+	var attempts []Attempt
+	err := d.read.SelectContext(ctx, &attempts,
+		d.read.Rebind(`SELECT * FROM sync_attempt WHERE source_post_id = ? ORDER BY id`), sourcePostID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query attempts: %w", err)
+	}
+	return attempts, nil
+}
+
+// FailedAttempts returns up to limit attempts of any toot that failed
+// since the time, newest first, for looking into outages after the fact
+func (d *Datastore) FailedAttempts(ctx context.Context, since time.Time, limit int) ([]Attempt, error) {
+	var attempts []Attempt
+	err := d.read.SelectContext(ctx, &attempts, d.read.Rebind(
+		`SELECT * FROM sync_attempt
+			WHERE error != '' AND started_at >= ?
+			ORDER BY started_at DESC, id DESC
+			LIMIT ?`), since.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query failed attempts: %w", err)
+	}
+	return attempts, nil
+}
+
+// failedStage is the stage an error in converting or posting came from
+func failedStage(err error, posting bool) Stage {
+	switch {
+	case errors.Is(err, bsky.ErrFetchMedia):
+		return StageFetch
+	case errors.Is(err, bsky.ErrUploadBlob):
+		return StageUpload
+	case posting:
+		return StagePost
+	}
+	return StageConvert
+}
+
+// errorClass sums up an error for the attempt history.  The typed errors
+// of the clients give their kind, anything else is "other".
+func errorClass(err error) string {
+	if err == nil {
+		return ""
+	}
+	var rerr *remote.Error
+	if errors.As(err, &rerr) {
+		return rerr.Service + " " + rerr.Kind.String()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	var uerr *url.Error
+	var nerr net.Error
+	if errors.As(err, &uerr) || errors.As(err, &nerr) {
+		return "network error"
+	}
+	return "other"
+}
@@ -0,0 +1,88 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/willgorman/mastodon-bsky/pkg/bsky"
+	"github.com/willgorman/mastodon-bsky/pkg/remote"
+	"gotest.tools/assert"
+)
+
+func testAttempts(t *testing.T, ds Store) {
+	ctx := context.Background()
+	start := time.Date(2024, 1, 20, 15, 0, 0, 0, time.UTC)
+	attempts := []Attempt{
+		{SourcePostID: "a", Attempt: 1, StartedAt: start, Stage: StageFetch, Duration: 1500 * time.Millisecond, ErrorClass: "network error", Error: "connection refused"},
+		{SourcePostID: "b", Attempt: 1, StartedAt: start.Add(time.Minute), Stage: StagePost, Duration: time.Second, ErrorClass: "bluesky upstream error", Error: "502"},
+		{SourcePostID: "a", Attempt: 2, StartedAt: start.Add(2 * time.Minute), Stage: StagePost, Duration: 2 * time.Second, TargetPostURI: "at://did:plc:test/app.bsky.feed.post/1", TargetPostCID: "cid"},
+	}
+	for _, a := range attempts {
+		assert.NilError(t, ds.AddAttempt(ctx, a))
+	}
+
+	got, err := ds.ListAttempts(ctx, "a")
+	assert.NilError(t, err)
+	assert.Equal(t, len(got), 2)
+	for i, want := range []Attempt{attempts[0], attempts[2]} {
+		want.ID = got[i].ID
+		assert.Assert(t, got[i].StartedAt.Equal(want.StartedAt))
+		got[i].StartedAt = want.StartedAt
+		assert.DeepEqual(t, got[i], want)
+	}
+	assert.Assert(t, got[0].Failed())
+	assert.Assert(t, !got[1].Failed())
+
+	failed, err := ds.FailedAttempts(ctx, start, 10)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{failed[0].SourcePostID, failed[1].SourcePostID}, []string{"b", "a"})
+	failed, err = ds.FailedAttempts(ctx, start.Add(30*time.Second), 10)
+	assert.NilError(t, err)
+	assert.Equal(t, len(failed), 1)
+}
+
+func TestFailedStage(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		posting bool
+		stage   Stage
+		class   string
+	}{
+		{
+			name:  "media host down",
+			err:   fmt.Errorf("%w: image from https://files.example.com/1.png: %w", bsky.ErrFetchMedia, &url.Error{Op: "Get", Err: errors.New("connection refused")}),
+			stage: StageFetch,
+			class: "network error",
+		},
+		{name: "template", err: errors.New("template: bad"), stage: StageConvert, class: "other"},
+		{
+			name:    "upload",
+			err:     fmt.Errorf("%w: %w", bsky.ErrUploadBlob, &remote.Error{Service: "bluesky", Kind: remote.Upstream, StatusCode: http.StatusBadGateway, Err: errors.New("bad gateway")}),
+			posting: true,
+			stage:   StageUpload,
+			class:   "bluesky upstream error",
+		},
+		{
+			name:    "post",
+			err:     &remote.Error{Service: "bluesky", Kind: remote.RateLimited, StatusCode: http.StatusTooManyRequests, Err: errors.New("slow down")},
+			posting: true,
+			stage:   StagePost,
+			class:   "bluesky rate limited",
+		},
+		{name: "mastodon", err: &remote.Error{Service: "mastodon", Kind: remote.NotFound, Err: errors.New("gone")}, stage: StageConvert, class: "mastodon not found"},
+		{name: "timeout", err: fmt.Errorf("posting: %w", context.DeadlineExceeded), posting: true, stage: StagePost, class: "timeout"},
+		{name: "success", posting: true, stage: StagePost},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, failedStage(tt.err, tt.posting), tt.stage)
+			assert.Equal(t, errorClass(tt.err), tt.class)
+		})
+	}
+}
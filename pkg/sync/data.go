@@ -3,65 +3,87 @@ package sync
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "modernc.org/sqlite"
 )
 
-const create string = `
-	CREATE TABLE IF NOT EXISTS sync_record (
-		source_post_id TEXT PRIMARY KEY,
-		source_post_url TEXT,
-		target_post_id TEXT,
-		target_post_url TEXT,
-		added_at DATETIME NOT NULL,
-		synced_at DATETIME NULL,
-		attempts INT DEFAULT 0 NOT NULL,
-		last_error TEXT DEFAULT "" NOT NULL
-	);
-`
-
 type SyncRecord struct {
 	AddedAt       time.Time    `db:"added_at"`
 	SyncedAt      sql.NullTime `db:"synced_at"`
 	SourcePostID  string       `db:"source_post_id"`
 	SourcePostURL string       `db:"source_post_url"`
-	TargetPostID  string       `db:"target_post_id"`
-	TargetPostURL string       `db:"target_post_url"`
-	Attempts      int          `db:"attempts"`
-	LastError     string       `db:"last_error"`
+	// TargetPostID is the at-uri of the post the toot became, and
+	// TargetPostURL is where it is on bsky.app
+	TargetPostID   string `db:"target_post_id"`
+	TargetPostCID  string `db:"target_post_cid"`
+	TargetPostRkey string `db:"target_post_rkey"`
+	TargetPostURL  string `db:"target_post_url"`
+	Attempts       int    `db:"attempts"`
+	LastError      string `db:"last_error"`
+	SkipReason     string `db:"skip_reason"`
+	State          State  `db:"state"`
+	// NextAttemptAt is when a StateFailedTransient record is due a retry
+	NextAttemptAt sql.NullTime `db:"next_attempt_at"`
+	// Toot is the JSON of the toot, kept to retry it
+	Toot string `db:"toot"`
 }
 
-func CreateDatastore(path string) (*Datastore, error) {
-	db, err := sqlx.Open("sqlite", path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open %s: %w", path, err)
-	}
-	_, err = db.Exec(create)
-	if err != nil {
-		return nil, fmt.Errorf("failed to exec create: %w", err)
+// sqliteDSN is the connection string for the writer.  WAL lets readers
+// carry on while it writes, and with WAL synchronous NORMAL only syncs at
+// checkpoints without risking corruption.  Transactions take the write
+// lock when they begin instead of failing with SQLITE_BUSY when they
+// first write, and busy_timeout waits for other processes holding it.
+func sqliteDSN(path string) string {
+	return withParams(path, "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_txlock=immediate")
+}
+
+// sqliteReadDSN is the connection string for the readers
+func sqliteReadDSN(path string) string {
+	return withParams(path, "_pragma=busy_timeout(5000)&_pragma=query_only(1)")
+}
+
+// withParams adds query parameters to a path, which can be a file: URI
+// that already has some
+func withParams(path, params string) string {
+	if strings.Contains(path, "?") {
+		return path + "&" + params
 	}
+	return path + "?" + params
+}
 
-	return &Datastore{db: db}, nil
+// CreateDatastore opens the SQLite database at path, creating it if it
+// isn't there, and brings its schema up to date
+func CreateDatastore(path string) (*Datastore, error) {
+	return OpenDatastore(path)
 }
 
+// Datastore is a Store in a SQL database
 type Datastore struct {
-	db *sqlx.DB
+	// db writes, and read is the pool for queries, which is the same pool
+	// unless the dialect has readers of its own
+	db      *sqlx.DB
+	read    *sqlx.DB
+	dialect dialect
 }
 
+// OpenDatastore opens the SQLite database at path and applies any
+// migrations it doesn't have yet
 func OpenDatastore(path string) (*Datastore, error) {
-	db, err := sqlx.Open("sqlite", path)
+	d, err := open(sqliteDialect, path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+		return nil, fmt.Errorf("%s: %w", path, err)
 	}
-	return &Datastore{db: db}, nil
+	return d, nil
 }
 
 func (d *Datastore) ListRecords(ctx context.Context) ([]SyncRecord, error) {
 	var records []SyncRecord
-	err := d.db.SelectContext(ctx, &records, `SELECT * FROM sync_record`)
+	err := d.read.SelectContext(ctx, &records, `SELECT * FROM sync_record`)
 	if err != nil {
 		return nil, fmt.Errorf("unable to query records: %w", err)
 	}
@@ -70,29 +92,157 @@ func (d *Datastore) ListRecords(ctx context.Context) ([]SyncRecord, error) {
 
 func (d *Datastore) GetRecord(ctx context.Context, sourcePostID string) (*SyncRecord, error) {
 	record := SyncRecord{}
-	err := d.db.GetContext(ctx, &record,
-		`SELECT * FROM sync_record WHERE source_post_id = ?`, sourcePostID)
+	err := d.read.GetContext(ctx, &record,
+		d.read.Rebind(`SELECT * FROM sync_record WHERE source_post_id = ?`), sourcePostID)
 	return &record, err
 }
 
+// CreateRecord adds a record, which starts out pending or skipped
 func (d *Datastore) CreateRecord(ctx context.Context, record SyncRecord) error {
 	if record.AddedAt.IsZero() {
 		record.AddedAt = time.Now().UTC()
 	}
+	if record.State == "" {
+		record.State = StatePending
+	}
+	if record.State != StatePending && record.State != StateSkipped {
+		return fmt.Errorf("%w: records can't start %s", ErrInvalidTransition, record.State)
+	}
 	_, err := d.db.NamedExecContext(ctx,
-		`INSERT INTO sync_record (added_at, synced_at, source_post_id, source_post_url, target_post_id, target_post_url, attempts)
-			VALUES (:added_at, :synced_at, :source_post_id, :source_post_url, :target_post_id, :target_post_url, 0)
+		`INSERT INTO sync_record (added_at, synced_at, source_post_id, source_post_url, target_post_id, target_post_cid, target_post_rkey, target_post_url, attempts, skip_reason, state, toot)
+			VALUES (:added_at, :synced_at, :source_post_id, :source_post_url, :target_post_id, :target_post_cid, :target_post_rkey, :target_post_url, 0, :skip_reason, :state, :toot)
 		`, &record)
 	return err
 }
 
-func (d *Datastore) UpdateRecord(ctx context.Context, record SyncRecord) error {
-	_, err := d.db.NamedExecContext(ctx,
-		`UPDATE sync_record 
-			SET synced_at = CURRENT_TIMESTAMP, 
-					target_post_id = :target_post_id, 
-					target_post_url = :target_post_url,
-					last_error = :last_error,
-					attempts = attempts+1`, &record)
-	return err
+// Transition moves a record from its State to the next state, saving the
+// target post, error, skip reason and next attempt with it.  Starting another attempt
+// by moving to StateConverting counts towards Attempts.  If the record in
+// the database isn't in the same state any more it returns ErrStaleState,
+// so only one of two concurrent transitions from a state succeeds.
+func (d *Datastore) Transition(ctx context.Context, record *SyncRecord, to State) error {
+	if !record.State.CanTransition(to) {
+		return fmt.Errorf("%w: %s from %s to %s", ErrInvalidTransition, record.SourcePostID, record.State, to)
+	}
+	attempt := 0
+	if to == StateConverting {
+		attempt = 1
+	}
+	syncedAt := record.SyncedAt
+	if to == StatePosted && !syncedAt.Valid {
+		syncedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	}
+	result, err := d.db.ExecContext(ctx, d.db.Rebind(
+		`UPDATE sync_record
+			SET state = ?,
+				synced_at = ?,
+				target_post_id = ?,
+				target_post_cid = ?,
+				target_post_rkey = ?,
+				target_post_url = ?,
+				last_error = ?,
+				skip_reason = ?,
+				next_attempt_at = ?,
+				attempts = attempts + ?
+			WHERE source_post_id = ? AND state = ?`),
+		to, syncedAt, record.TargetPostID, record.TargetPostCID, record.TargetPostRkey, record.TargetPostURL, record.LastError, record.SkipReason, record.NextAttemptAt, attempt,
+		record.SourcePostID, record.State)
+	if err != nil {
+		return fmt.Errorf("unable to update record %s: %w", record.SourcePostID, err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("unable to update record %s: %w", record.SourcePostID, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s is no longer %s", ErrStaleState, record.SourcePostID, record.State)
+	}
+	record.State = to
+	record.SyncedAt = syncedAt
+	record.Attempts += attempt
+	return nil
+}
+
+// DueRecords returns up to limit records that failed and are due to be
+// tried again at now, the longest overdue first.
+func (d *Datastore) DueRecords(ctx context.Context, now time.Time, limit int) ([]SyncRecord, error) {
+	var records []SyncRecord
+	err := d.read.SelectContext(ctx, &records, d.read.Rebind(
+		`SELECT * FROM sync_record
+			WHERE state = ? AND next_attempt_at <= ?
+			ORDER BY next_attempt_at
+			LIMIT ?`), StateFailedTransient, now.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query due records: %w", err)
+	}
+	return records, nil
+}
+
+// RecoverInterrupted moves records that a run stopped in the middle of,
+// by crashing or being stopped, to StateFailedTransient due at now so
+// they get retried.  Only the instance holding the lease should call it,
+// while it has nothing in progress.
+func (d *Datastore) RecoverInterrupted(ctx context.Context, now time.Time) (int64, error) {
+	result, err := d.db.ExecContext(ctx, d.db.Rebind(
+		`UPDATE sync_record
+			SET state = ?,
+				next_attempt_at = ?,
+				last_error = CASE WHEN last_error = '' THEN ? ELSE last_error END
+			WHERE state IN (?, ?, ?)`),
+		StateFailedTransient, now.UTC(), "interrupted before it was finished",
+		StatePending, StateConverting, StatePosting)
+	if err != nil {
+		return 0, fmt.Errorf("unable to recover interrupted records: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("unable to recover interrupted records: %w", err)
+	}
+	return n, nil
+}
+
+// GetCheckpoint returns the newest status ID that has been handled for the
+// source, or "" if there isn't one yet.
+func (d *Datastore) GetCheckpoint(ctx context.Context, source string) (string, error) {
+	var statusID string
+	err := d.read.GetContext(ctx, &statusID,
+		d.read.Rebind(`SELECT status_id FROM checkpoint WHERE source = ?`), source)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to query checkpoint: %w", err)
+	}
+	return statusID, nil
+}
+
+// SetCheckpoint moves the checkpoint for the source forward to statusID.
+// Mastodon IDs are numeric strings so an ID that is older than the current
+// checkpoint is ignored.  Other IDs, like the ActivityPub IDs from an
+// outbox, don't sort so they always replace the checkpoint.
+func (d *Datastore) SetCheckpoint(ctx context.Context, source, statusID string) error {
+	_, err := d.db.ExecContext(ctx, d.db.Rebind(
+		`INSERT INTO checkpoint (source, status_id, updated_at) VALUES (?, ?, ?)
+			ON CONFLICT (source) DO UPDATE
+			SET status_id = excluded.status_id, updated_at = excluded.updated_at
+			WHERE `+d.dialect.nonNumeric("excluded.status_id")+` OR `+d.dialect.nonNumeric("checkpoint.status_id")+`
+				OR length(excluded.status_id) > length(checkpoint.status_id)
+				OR (length(excluded.status_id) = length(checkpoint.status_id) AND excluded.status_id > checkpoint.status_id)
+		`), source, statusID, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("unable to set checkpoint: %w", err)
+	}
+	return nil
+}
+
+// MoveCheckpoint carries the checkpoint of a source over to the account it
+// moved to.  Mastodon IDs start with the time they were posted so the old
+// checkpoint still works on the new server.  Sync records are keyed by
+// the status they came from so they don't need to move.
+func (d *Datastore) MoveCheckpoint(ctx context.Context, from, to string) error {
+	statusID, err := d.GetCheckpoint(ctx, from)
+	if err != nil || statusID == "" {
+		return err
+	}
+	return d.SetCheckpoint(ctx, to, statusID)
 }
@@ -2,9 +2,15 @@ package sync
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -39,19 +45,358 @@ func TestRecords(t *testing.T) {
 	assert.NilError(t, err)
 	litter.Dump(record)
 
+	assert.NilError(t, ds.Transition(context.Background(), record, StateConverting))
 	record.LastError = "oh no"
-	err = ds.UpdateRecord(context.Background(), *record)
+	err = ds.Transition(context.Background(), record, StateFailedTransient)
 	assert.NilError(t, err)
 	litter.Dump(ds.GetRecord(context.Background(), "a"))
 
+	assert.NilError(t, ds.Transition(context.Background(), record, StateConverting))
+	assert.NilError(t, ds.Transition(context.Background(), record, StatePosting))
 	record.LastError = ""
 	record.TargetPostID = "c"
 	record.TargetPostURL = "http://example.com"
-	err = ds.UpdateRecord(context.Background(), *record)
+	err = ds.Transition(context.Background(), record, StatePosted)
 	assert.NilError(t, err)
 	litter.Dump(ds.GetRecord(context.Background(), "a"))
 }
 
+func testCheckpoint(t *testing.T, ds Store) {
+	ctx := context.Background()
+
+	id, err := ds.GetCheckpoint(ctx, "https://example.com/@me")
+	assert.NilError(t, err)
+	assert.Equal(t, id, "")
+
+	assert.NilError(t, ds.SetCheckpoint(ctx, "https://example.com/@me", "99"))
+	assert.NilError(t, ds.SetCheckpoint(ctx, "https://example.com/@me", "111795667004443647"))
+	// older IDs don't move the checkpoint back
+	assert.NilError(t, ds.SetCheckpoint(ctx, "https://example.com/@me", "111795665359033449"))
+	assert.NilError(t, ds.SetCheckpoint(ctx, "https://example.com/@me", "999"))
+	assert.NilError(t, ds.SetCheckpoint(ctx, "https://example.com/@other", "5"))
+	// activitypub IDs are in the order they were sent
+	assert.NilError(t, ds.SetCheckpoint(ctx, "https://example.com/users/ap", "https://example.com/objects/b"))
+	assert.NilError(t, ds.SetCheckpoint(ctx, "https://example.com/users/ap", "https://example.com/objects/a"))
+
+	id, err = ds.GetCheckpoint(ctx, "https://example.com/@me")
+	assert.NilError(t, err)
+	assert.Equal(t, id, "111795667004443647")
+	id, err = ds.GetCheckpoint(ctx, "https://example.com/@other")
+	assert.NilError(t, err)
+	assert.Equal(t, id, "5")
+	id, err = ds.GetCheckpoint(ctx, "https://example.com/users/ap")
+	assert.NilError(t, err)
+	assert.Equal(t, id, "https://example.com/objects/a")
+}
+
+func testMoveCheckpoint(t *testing.T, ds Store) {
+	ctx := context.Background()
+
+	assert.NilError(t, ds.MoveCheckpoint(ctx, "https://old.example/@me", "https://new.example/@me"))
+	id, err := ds.GetCheckpoint(ctx, "https://new.example/@me")
+	assert.NilError(t, err)
+	assert.Equal(t, id, "")
+
+	assert.NilError(t, ds.SetCheckpoint(ctx, "https://old.example/@me", "111795667004443647"))
+	assert.NilError(t, ds.SetCheckpoint(ctx, "https://new.example/@me", "111795665359033449"))
+	assert.NilError(t, ds.MoveCheckpoint(ctx, "https://old.example/@me", "https://new.example/@me"))
+	id, err = ds.GetCheckpoint(ctx, "https://new.example/@me")
+	assert.NilError(t, err)
+	assert.Equal(t, id, "111795667004443647")
+}
+
+func testTransition(t *testing.T, ds Store) {
+	ctx := context.Background()
+	assert.NilError(t, ds.CreateRecord(ctx, SyncRecord{SourcePostID: "a"}))
+	assert.NilError(t, ds.CreateRecord(ctx, SyncRecord{SourcePostID: "b"}))
+
+	record, err := ds.GetRecord(ctx, "a")
+	assert.NilError(t, err)
+	assert.Equal(t, record.State, StatePending)
+
+	err = ds.Transition(ctx, record, StatePosted)
+	assert.Assert(t, errors.Is(err, ErrInvalidTransition), err)
+
+	assert.NilError(t, ds.Transition(ctx, record, StateConverting))
+	assert.NilError(t, ds.Transition(ctx, record, StatePosting))
+	record.LastError = "timeout"
+	assert.NilError(t, ds.Transition(ctx, record, StateFailedTransient))
+	assert.NilError(t, ds.Transition(ctx, record, StateConverting))
+	assert.NilError(t, ds.Transition(ctx, record, StatePosting))
+	record.LastError = ""
+	record.TargetPostID = "at://did:plc:test/app.bsky.feed.post/1"
+	record.TargetPostCID = "cid"
+	record.TargetPostRkey = "1"
+	record.TargetPostURL = "https://bsky.app/profile/test.bsky.social/post/1"
+	assert.NilError(t, ds.Transition(ctx, record, StatePosted))
+
+	got, err := ds.GetRecord(ctx, "a")
+	assert.NilError(t, err)
+	assert.Equal(t, got.State, StatePosted)
+	assert.Equal(t, got.Attempts, 2)
+	assert.Equal(t, got.TargetPostID, "at://did:plc:test/app.bsky.feed.post/1")
+	assert.Equal(t, got.TargetPostCID, "cid")
+	assert.Equal(t, got.TargetPostRkey, "1")
+	assert.Equal(t, got.TargetPostURL, "https://bsky.app/profile/test.bsky.social/post/1")
+	assert.Assert(t, got.SyncedAt.Valid)
+
+	// the other record is untouched
+	other, err := ds.GetRecord(ctx, "b")
+	assert.NilError(t, err)
+	assert.Equal(t, other.State, StatePending)
+	assert.Equal(t, other.Attempts, 0)
+	assert.Equal(t, other.TargetPostID, "")
+
+	err = ds.CreateRecord(ctx, SyncRecord{SourcePostID: "c", State: StatePosted})
+	assert.Assert(t, errors.Is(err, ErrInvalidTransition), err)
+}
+
+func testTransitionOnlyUpdatesItsRow(t *testing.T, ds Store) {
+	ctx := context.Background()
+	assert.NilError(t, ds.CreateRecord(ctx, SyncRecord{SourcePostID: "a"}))
+	assert.NilError(t, ds.CreateRecord(ctx, SyncRecord{SourcePostID: "b"}))
+
+	record := &SyncRecord{SourcePostID: "a", State: StatePending, TargetPostID: "cid"}
+	assert.NilError(t, ds.Transition(ctx, record, StateConverting))
+	other, err := ds.GetRecord(ctx, "b")
+	assert.NilError(t, err)
+	assert.Equal(t, other.TargetPostID, "")
+	assert.Equal(t, other.Attempts, 0)
+}
+
+func testRecoverInterrupted(t *testing.T, ds Store) {
+	ctx := context.Background()
+	for _, id := range []string{"pending", "converting", "posting", "posted", "failed"} {
+		assert.NilError(t, ds.CreateRecord(ctx, SyncRecord{SourcePostID: id}))
+	}
+	move := func(id string, to ...State) {
+		record, err := ds.GetRecord(ctx, id)
+		assert.NilError(t, err)
+		for _, state := range to {
+			assert.NilError(t, ds.Transition(ctx, record, state))
+		}
+	}
+	move("converting", StateConverting)
+	move("posting", StateConverting, StatePosting)
+	move("posted", StateConverting, StatePosting, StatePosted)
+	later := time.Now().Add(time.Hour)
+	record, err := ds.GetRecord(ctx, "failed")
+	assert.NilError(t, err)
+	assert.NilError(t, ds.Transition(ctx, record, StateConverting))
+	record.LastError = "timeout"
+	record.NextAttemptAt = sql.NullTime{Time: later, Valid: true}
+	assert.NilError(t, ds.Transition(ctx, record, StateFailedTransient))
+
+	now := time.Now()
+	n, err := ds.RecoverInterrupted(ctx, now)
+	assert.NilError(t, err)
+	assert.Equal(t, n, int64(3))
+	due, err := ds.DueRecords(ctx, now, 10)
+	assert.NilError(t, err)
+	var ids []string
+	for _, record := range due {
+		ids = append(ids, record.SourcePostID)
+		assert.Equal(t, record.State, StateFailedTransient)
+		assert.Equal(t, record.LastError, "interrupted before it was finished")
+	}
+	sort.Strings(ids)
+	assert.DeepEqual(t, ids, []string{"converting", "pending", "posting"})
+
+	// the rest are as they were
+	record, err = ds.GetRecord(ctx, "posted")
+	assert.NilError(t, err)
+	assert.Equal(t, record.State, StatePosted)
+	record, err = ds.GetRecord(ctx, "failed")
+	assert.NilError(t, err)
+	assert.Equal(t, record.LastError, "timeout")
+	assert.Assert(t, record.NextAttemptAt.Time.After(now))
+}
+
+func testConcurrentTransitions(t *testing.T, ds Store) {
+	ctx := context.Background()
+	const n = 20
+	for i := 0; i < n; i++ {
+		assert.NilError(t, ds.CreateRecord(ctx, SyncRecord{SourcePostID: fmt.Sprint(i)}))
+	}
+
+	// everyone races to start the same record and only one wins
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			record := SyncRecord{SourcePostID: "0", State: StatePending}
+			errs <- ds.Transition(ctx, &record, StateConverting)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	won := 0
+	for err := range errs {
+		if err == nil {
+			won++
+			continue
+		}
+		assert.Assert(t, errors.Is(err, ErrStaleState), err)
+	}
+	assert.Equal(t, won, 1)
+	record, err := ds.GetRecord(ctx, "0")
+	assert.NilError(t, err)
+	assert.Equal(t, record.Attempts, 1)
+
+	// different records don't get in each other's way
+	for i := 1; i < n; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			record := SyncRecord{SourcePostID: id, State: StatePending}
+			assert.Check(t, ds.Transition(ctx, &record, StateConverting))
+			record.SkipReason = "skip " + id
+			assert.Check(t, ds.Transition(ctx, &record, StateSkipped))
+		}(fmt.Sprint(i))
+	}
+	wg.Wait()
+	records, err := ds.ListRecords(ctx)
+	assert.NilError(t, err)
+	for _, record := range records {
+		if record.SourcePostID == "0" {
+			continue
+		}
+		assert.Equal(t, record.State, StateSkipped)
+		assert.Equal(t, record.SkipReason, "skip "+record.SourcePostID)
+	}
+}
+
+func TestPragmas(t *testing.T) {
+	tests := []struct {
+		name string
+		path func(dir string) string
+	}{
+		{name: "path", path: func(dir string) string { return dir + "/sync.db" }},
+		{name: "uri with options", path: func(dir string) string { return "file:" + dir + "/sync.db?cache=private" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ds, err := CreateDatastore(tt.path(dir))
+			assert.NilError(t, err)
+			defer ds.Close()
+
+			var mode string
+			assert.NilError(t, ds.db.Get(&mode, `PRAGMA journal_mode`))
+			assert.Equal(t, mode, "wal")
+			var timeout int
+			assert.NilError(t, ds.read.Get(&timeout, `PRAGMA busy_timeout`))
+			assert.Equal(t, timeout, 5000)
+			// the readers can't write by mistake
+			_, err = ds.read.Exec(`DELETE FROM sync_record`)
+			assert.ErrorContains(t, err, "readonly")
+			_, err = os.Stat(dir + "/sync.db")
+			assert.NilError(t, err)
+		})
+	}
+	assert.Equal(t, sqliteReadDSN("file:sync.db?mode=rwc"), "file:sync.db?mode=rwc&_pragma=busy_timeout(5000)&_pragma=query_only(1)")
+}
+
+// TestStress is crossposting a few thousand toots at once while reading,
+// which used to fail with "database is locked"
+func TestStress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("slow")
+	}
+	ds, err := CreateDatastore(fmt.Sprintf("%s/sync.db", t.TempDir()))
+	assert.NilError(t, err)
+	defer ds.Close()
+	ctx := context.Background()
+
+	const workers, perWorker = 16, 125
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				_, err := ds.DueRecords(ctx, time.Now(), 100)
+				assert.Check(t, err)
+				_, err = ds.ListRecords(ctx)
+				assert.Check(t, err)
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				if !assert.Check(t, lifecycle(ctx, ds, fmt.Sprintf("%d-%d", w, i))) {
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	records, err := ds.ListRecords(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, len(records), workers*perWorker)
+	for _, record := range records {
+		assert.Equal(t, record.State, StatePosted)
+		assert.Equal(t, record.Attempts, 1)
+	}
+}
+
+func BenchmarkRecordLifecycle(b *testing.B) {
+	ds, err := CreateDatastore(fmt.Sprintf("%s/sync.db", b.TempDir()))
+	assert.NilError(b, err)
+	defer ds.Close()
+	ctx := context.Background()
+
+	var n atomic.Int64
+	start := time.Now()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := lifecycle(ctx, ds, fmt.Sprint(n.Add(1))); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.ReportMetric(float64(n.Load())/time.Since(start).Seconds(), "records/s")
+}
+
+// lifecycle takes a new record all the way to posted, like the processor
+// does for a toot
+func lifecycle(ctx context.Context, ds Store, id string) error {
+	if err := ds.CreateRecord(ctx, SyncRecord{SourcePostID: id}); err != nil {
+		return err
+	}
+	record, err := ds.GetRecord(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, to := range []State{StateConverting, StatePosting, StatePosted} {
+		if to == StatePosted {
+			record.TargetPostID = "at://" + id
+		}
+		if err := ds.Transition(ctx, record, to); err != nil {
+			return err
+		}
+	}
+	return ds.AddAttempt(ctx, Attempt{SourcePostID: id, Attempt: 1, StartedAt: time.Now(), Stage: StagePost})
+}
+
 func init() {
 	timeType := reflect.TypeOf(time.Time{})
 	litter.Config.DumpFunc = func(v reflect.Value, w io.Writer) bool {
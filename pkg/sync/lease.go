@@ -0,0 +1,180 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// runLease is the lease an instance has to hold to crosspost from a
+// source
+func runLease(sourceID string) string {
+	return "run " + sourceID
+}
+
+// ErrLeaseHeld is returned when another instance holds the lease
+var ErrLeaseHeld = errors.New("lease is held by another instance")
+
+// ErrLeaseLost is returned when renewing a lease that another instance
+// has taken over since it expired
+var ErrLeaseLost = errors.New("lease was lost")
+
+// AcquireLease takes the lease for holder until ttl from now if nobody
+// holds it, its holder let it expire, or holder already has it.
+// Otherwise it returns ErrLeaseHeld.  Leases go by the database's clock.
+func (d *Datastore) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) error {
+	result, err := d.db.ExecContext(ctx, d.db.Rebind(
+		`INSERT INTO lease (name, holder, heartbeat, expires_at) VALUES (?, ?, `+d.dialect.now+`, `+d.dialect.later+`)
+			ON CONFLICT (name) DO UPDATE
+				SET holder = excluded.holder, heartbeat = excluded.heartbeat, expires_at = excluded.expires_at
+				WHERE lease.holder = excluded.holder OR lease.expires_at < excluded.heartbeat`),
+		name, holder, ttl.Seconds())
+	if err != nil {
+		return fmt.Errorf("unable to acquire lease %s: %w", name, err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("unable to acquire lease %s: %w", name, err)
+	}
+	if n > 0 {
+		return nil
+	}
+	var current struct {
+		Holder    string    `db:"holder"`
+		ExpiresAt time.Time `db:"expires_at"`
+	}
+	err = d.read.GetContext(ctx, &current,
+		d.read.Rebind(`SELECT holder, expires_at FROM lease WHERE name = ?`), name)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrLeaseHeld, name)
+	}
+	return fmt.Errorf("%w: %s is held by %s until %s", ErrLeaseHeld, name, current.Holder, current.ExpiresAt.Local().Format(time.RFC3339))
+}
+
+// RenewLease moves the expiry of a lease holder has to ttl from now.  It
+// returns ErrLeaseLost if holder doesn't have the lease any more.
+func (d *Datastore) RenewLease(ctx context.Context, name, holder string, ttl time.Duration) error {
+	result, err := d.db.ExecContext(ctx, d.db.Rebind(
+		`UPDATE lease SET heartbeat = `+d.dialect.now+`, expires_at = `+d.dialect.later+` WHERE name = ? AND holder = ?`),
+		ttl.Seconds(), name, holder)
+	if err != nil {
+		return fmt.Errorf("unable to renew lease %s: %w", name, err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("unable to renew lease %s: %w", name, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: %s is no longer held by %s", ErrLeaseLost, name, holder)
+	}
+	return nil
+}
+
+// ReleaseLease gives up the lease if holder has it, so another instance
+// doesn't have to wait for it to expire
+func (d *Datastore) ReleaseLease(ctx context.Context, name, holder string) error {
+	_, err := d.db.ExecContext(ctx, d.db.Rebind(
+		`DELETE FROM lease WHERE name = ? AND holder = ?`), name, holder)
+	if err != nil {
+		return fmt.Errorf("unable to release lease %s: %w", name, err)
+	}
+	return nil
+}
+
+// Lease keeps a second instance from crossposting from the same source
+// and posting everything twice.  Instances with different sources can
+// share a database.  The holder heartbeats to keep it, and if
+// it stops for longer than the TTL another instance can take over.
+type Lease struct {
+	data   Store
+	name   string
+	holder string
+	ttl    time.Duration
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// NewLease is the lease for crossposting from the source with sourceID, for
+// holder, which has to be unique to the instance
+func NewLease(data Store, sourceID, holder string, ttl time.Duration) *Lease {
+	return &Lease{
+		data:   data,
+		name:   runLease(sourceID),
+		holder: holder,
+		ttl:    ttl,
+		done:   make(chan struct{}),
+	}
+}
+
+// Acquire takes the lease, or returns ErrLeaseHeld if another instance
+// has it
+func (l *Lease) Acquire(ctx context.Context) error {
+	return l.data.AcquireLease(ctx, l.name, l.holder, l.ttl)
+}
+
+// Wait stands by until the lease is free and takes it
+func (l *Lease) Wait(ctx context.Context) error {
+	logged := false
+	for {
+		err := l.Acquire(ctx)
+		if !errors.Is(err, ErrLeaseHeld) {
+			return err
+		}
+		if !logged {
+			log.Printf("standing by: %s", err)
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(l.interval()):
+		}
+	}
+}
+
+// Hold heartbeats until ctx is done or the lease is closed.  It returns
+// ErrLeaseLost if another instance took the lease, or if it couldn't be
+// renewed for so long that another instance could have.
+func (l *Lease) Hold(ctx context.Context) error {
+	ticker := time.NewTicker(l.interval())
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-l.done:
+			return nil
+		case <-ticker.C:
+		}
+		err := l.data.RenewLease(ctx, l.name, l.holder, l.ttl)
+		switch {
+		case err == nil:
+			renewed = time.Now()
+		case errors.Is(err, ErrLeaseLost):
+			return err
+		case time.Since(renewed) >= l.ttl:
+			return fmt.Errorf("%w: not renewed since %s: %w", ErrLeaseLost, renewed.Format(time.RFC3339), err)
+		default:
+			log.Printf("renewing lease: %s", err)
+		}
+	}
+}
+
+// Close stops heartbeating and releases the lease
+func (l *Lease) Close() error {
+	l.doneOnce.Do(func() { close(l.done) })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return l.data.ReleaseLease(ctx, l.name, l.holder)
+}
+
+// interval is how often to heartbeat, often enough that a couple can be
+// missed before the lease expires
+func (l *Lease) interval() time.Duration {
+	return l.ttl / 3
+}
@@ -0,0 +1,92 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func testLease(t *testing.T, ds Store) {
+	ctx := context.Background()
+
+	assert.NilError(t, ds.AcquireLease(ctx, "run", "a", time.Minute))
+	// holding it again is fine
+	assert.NilError(t, ds.AcquireLease(ctx, "run", "a", time.Minute))
+	err := ds.AcquireLease(ctx, "run", "b", time.Minute)
+	assert.Assert(t, errors.Is(err, ErrLeaseHeld), err)
+	assert.ErrorContains(t, err, "held by a")
+	// other leases are separate
+	assert.NilError(t, ds.AcquireLease(ctx, "other", "b", time.Minute))
+	// like the run leases of different sources, held by different instances
+	assert.NilError(t, ds.AcquireLease(ctx, runLease("https://example.com/@a"), "a", time.Minute))
+	assert.NilError(t, ds.AcquireLease(ctx, runLease("https://example.com/@b"), "b", time.Minute))
+
+	assert.NilError(t, ds.RenewLease(ctx, "run", "a", time.Minute))
+	err = ds.RenewLease(ctx, "run", "b", time.Minute)
+	assert.Assert(t, errors.Is(err, ErrLeaseLost), err)
+
+	// b can only release its own
+	assert.NilError(t, ds.ReleaseLease(ctx, "run", "b"))
+	assert.Assert(t, errors.Is(ds.AcquireLease(ctx, "run", "b", time.Minute), ErrLeaseHeld))
+	assert.NilError(t, ds.ReleaseLease(ctx, "run", "a"))
+	assert.NilError(t, ds.AcquireLease(ctx, "run", "b", time.Minute))
+
+	// an expired lease can be taken over, and then its old holder has lost it
+	assert.NilError(t, ds.AcquireLease(ctx, "expiring", "a", -time.Second))
+	assert.NilError(t, ds.AcquireLease(ctx, "expiring", "b", time.Minute))
+	err = ds.RenewLease(ctx, "expiring", "a", time.Minute)
+	assert.Assert(t, errors.Is(err, ErrLeaseLost), err)
+}
+
+func TestLease(t *testing.T) {
+	ds, err := CreateDatastore(fmt.Sprintf("%s/sync.db", t.TempDir()))
+	assert.NilError(t, err)
+	defer ds.Close()
+	ctx := context.Background()
+	const ttl = 150 * time.Millisecond
+
+	first := NewLease(ds, "https://example.com/@me", "first", ttl)
+	assert.NilError(t, first.Acquire(ctx))
+	held := make(chan error, 1)
+	go func() { held <- first.Hold(ctx) }()
+
+	// heartbeats keep the second instance out for longer than the ttl
+	second := NewLease(ds, "https://example.com/@me", "second", ttl)
+	assert.Assert(t, errors.Is(second.Acquire(ctx), ErrLeaseHeld))
+	waitCtx, cancel := context.WithTimeout(ctx, 3*ttl)
+	defer cancel()
+	assert.Assert(t, errors.Is(second.Wait(waitCtx), context.DeadlineExceeded))
+
+	// until the first shuts down and the second takes over
+	waited := make(chan error, 1)
+	go func() { waited <- second.Wait(ctx) }()
+	assert.NilError(t, first.Close())
+	assert.NilError(t, <-held)
+	assert.NilError(t, <-waited)
+	defer second.Close()
+	assert.Assert(t, errors.Is(first.Acquire(ctx), ErrLeaseHeld))
+
+	// instances crossposting from different sources don't hold each other up
+	other := NewLease(ds, "https://example.com/@other", "first", ttl)
+	assert.NilError(t, other.Acquire(ctx))
+	defer other.Close()
+}
+
+func TestLeaseLost(t *testing.T) {
+	ds, err := CreateDatastore(fmt.Sprintf("%s/sync.db", t.TempDir()))
+	assert.NilError(t, err)
+	defer ds.Close()
+	ctx := context.Background()
+
+	lease := NewLease(ds, "https://example.com/@me", "first", 30*time.Millisecond)
+	assert.NilError(t, lease.Acquire(ctx))
+	// another instance took it, like after the first stalled past the ttl
+	assert.NilError(t, ds.ReleaseLease(ctx, runLease("https://example.com/@me"), "first"))
+	assert.NilError(t, ds.AcquireLease(ctx, runLease("https://example.com/@me"), "second", time.Minute))
+	err = lease.Hold(ctx)
+	assert.Assert(t, errors.Is(err, ErrLeaseLost), err)
+}
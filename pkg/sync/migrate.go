@@ -0,0 +1,239 @@
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migration changes the schema from the version before it to Version
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// loadMigrations reads the embedded migrations of the dialect, which are
+// named NNNN_name.sql and have to be numbered from 1 with no gaps
+func loadMigrations(dialect dialect) ([]migration, error) {
+	files, err := dialect.migrationFiles()
+	if err != nil {
+		return nil, err
+	}
+	names, err := fs.Glob(files, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+	var migrations []migration
+	for i, name := range names {
+		number, label, _ := strings.Cut(strings.TrimSuffix(name, ".sql"), "_")
+		version, err := strconv.Atoi(number)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s isn't numbered: %w", name, err)
+		}
+		if version != i+1 {
+			return nil, fmt.Errorf("migration %s should be number %d", name, i+1)
+		}
+		data, err := fs.ReadFile(files, name)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{Version: version, Name: label, SQL: string(data)})
+	}
+	return migrations, nil
+}
+
+// createSchemaVersion is the table of applied migrations, with the type
+// the dialect has for timestamps
+const createSchemaVersion = `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at %s NOT NULL
+	)
+`
+
+// MigrationStatus is whether a migration has been applied to a database
+type MigrationStatus struct {
+	Version   int          `db:"version"`
+	Name      string       `db:"name"`
+	AppliedAt sql.NullTime `db:"applied_at"`
+}
+
+// Migrate applies the migrations the database doesn't have yet in one
+// transaction.  Databases from before schema_version existed are taken to
+// be at the version their tables say they're at.
+func (d *Datastore) Migrate(ctx context.Context) error {
+	migrations, err := loadMigrations(d.dialect)
+	if err != nil {
+		return err
+	}
+	tx, err := d.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if d.dialect.lock != "" {
+		if _, err := tx.ExecContext(ctx, d.dialect.lock); err != nil {
+			return fmt.Errorf("locking schema_version: %w", err)
+		}
+	}
+	current, err := d.schemaVersion(ctx, tx, migrations)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+		if err := recordVersion(ctx, tx, m); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func recordVersion(ctx context.Context, tx *sqlx.Tx, m migration) error {
+	_, err := tx.ExecContext(ctx,
+		tx.Rebind(`INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)`),
+		m.Version, m.Name, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("recording migration %d: %w", m.Version, err)
+	}
+	return nil
+}
+
+// schemaVersion creates schema_version if it isn't there and returns the
+// newest version in it
+func (d *Datastore) schemaVersion(ctx context.Context, tx *sqlx.Tx, migrations []migration) (int, error) {
+	tables, err := d.listTables(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+	if !tables["schema_version"] {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(createSchemaVersion, d.dialect.timestamp)); err != nil {
+			return 0, fmt.Errorf("creating schema_version: %w", err)
+		}
+		if !d.dialect.legacy {
+			return 0, nil
+		}
+		return adoptLegacy(ctx, tx, tables, migrations)
+	}
+	var version sql.NullInt64
+	if err := tx.GetContext(ctx, &version, `SELECT MAX(version) FROM schema_version`); err != nil {
+		return 0, fmt.Errorf("reading schema_version: %w", err)
+	}
+	return int(version.Int64), nil
+}
+
+// legacyVersions tell which migrations a database from before
+// schema_version already has.  The schema used to be created and added to
+// in place, so whatever it has it has all of the versions before.
+var legacyVersions = []struct {
+	version int
+	has     func(tables, columns map[string]bool) bool
+}{
+	{1, func(tables, columns map[string]bool) bool { return tables["sync_record"] }},
+	{2, func(tables, columns map[string]bool) bool { return columns["skip_reason"] }},
+	{3, func(tables, columns map[string]bool) bool { return tables["checkpoint"] }},
+	{4, func(tables, columns map[string]bool) bool { return columns["state"] }},
+	{5, func(tables, columns map[string]bool) bool { return columns["next_attempt_at"] && columns["toot"] }},
+	{6, func(tables, columns map[string]bool) bool { return tables["sync_attempt"] }},
+}
+
+// adoptLegacy records the migrations an unversioned SQLite database
+// already has
+func adoptLegacy(ctx context.Context, tx *sqlx.Tx, tables map[string]bool, migrations []migration) (int, error) {
+	var names []string
+	if err := tx.SelectContext(ctx, &names, `SELECT name FROM pragma_table_info('sync_record')`); err != nil {
+		return 0, err
+	}
+	columns := map[string]bool{}
+	for _, name := range names {
+		columns[name] = true
+	}
+	version := 0
+	for _, legacy := range legacyVersions {
+		if !legacy.has(tables, columns) {
+			break
+		}
+		version = legacy.version
+		if err := recordVersion(ctx, tx, migrations[version-1]); err != nil {
+			return 0, err
+		}
+	}
+	return version, nil
+}
+
+func (d *Datastore) listTables(ctx context.Context, q sqlx.QueryerContext) (map[string]bool, error) {
+	var names []string
+	if err := sqlx.SelectContext(ctx, q, &names, d.dialect.tables); err != nil {
+		return nil, fmt.Errorf("listing tables: %w", err)
+	}
+	tables := map[string]bool{}
+	for _, name := range names {
+		tables[name] = true
+	}
+	return tables, nil
+}
+
+// SchemaStatus lists every migration and when it was applied to the
+// database at dataPath, without applying any
+func SchemaStatus(ctx context.Context, dataPath string) ([]MigrationStatus, error) {
+	dialect := postgresDialect
+	if !isPostgres(dataPath) {
+		// opening a database that isn't there would create it
+		if _, err := os.Stat(dataPath); err != nil {
+			return nil, err
+		}
+		dialect = sqliteDialect
+	}
+	d, err := connect(dialect, dataPath)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.SchemaStatus(ctx)
+}
+
+// SchemaStatus lists every migration and when it was applied
+func (d *Datastore) SchemaStatus(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(d.dialect)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := d.listTables(ctx, d.read)
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]sql.NullTime{}
+	var rows []MigrationStatus
+	if tables["schema_version"] {
+		err := d.read.SelectContext(ctx, &rows, `SELECT version, name, applied_at FROM schema_version`)
+		if err != nil {
+			return nil, fmt.Errorf("reading schema_version: %w", err)
+		}
+	}
+	for _, row := range rows {
+		applied[row.Version] = row.AppliedAt
+	}
+	var status []MigrationStatus
+	for _, m := range migrations {
+		status = append(status, MigrationStatus{Version: m.Version, Name: m.Name, AppliedAt: applied[m.Version]})
+	}
+	return status, nil
+}
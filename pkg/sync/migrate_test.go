@@ -0,0 +1,144 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"gotest.tools/assert"
+)
+
+// legacyDatabase makes a database at path from SQL, the way it was before
+// schema_version
+func legacyDatabase(t *testing.T, path string, sql ...string) {
+	t.Helper()
+	db, err := sqlx.Open("sqlite", path)
+	assert.NilError(t, err)
+	defer db.Close()
+	for _, s := range sql {
+		_, err := db.Exec(s)
+		assert.NilError(t, err)
+	}
+}
+
+func appliedVersions(t *testing.T, path string) []int {
+	t.Helper()
+	status, err := SchemaStatus(context.Background(), path)
+	assert.NilError(t, err)
+	var versions []int
+	for _, s := range status {
+		if s.AppliedAt.Valid {
+			versions = append(versions, s.Version)
+		}
+	}
+	return versions
+}
+
+func allVersions(t *testing.T) []int {
+	migrations, err := loadMigrations(sqliteDialect)
+	assert.NilError(t, err)
+	var versions []int
+	for _, m := range migrations {
+		versions = append(versions, m.Version)
+	}
+	return versions
+}
+
+func TestMigrateFromBaseline(t *testing.T) {
+	path := fmt.Sprintf("%s/sync.db", t.TempDir())
+	fixture, err := os.ReadFile("testdata/baseline.sql")
+	assert.NilError(t, err)
+	legacyDatabase(t, path, string(fixture))
+	assert.Equal(t, len(appliedVersions(t, path)), 0)
+
+	ds, err := OpenDatastore(path)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, appliedVersions(t, path), allVersions(t))
+	for id, want := range map[string]State{
+		"posted": StatePosted,
+		// its toot wasn't stored so it can't be retried
+		"failed":  StateFailedPermanent,
+		"pending": StatePending,
+	} {
+		record, err := ds.GetRecord(context.Background(), id)
+		assert.NilError(t, err)
+		assert.Equal(t, record.State, want, id)
+		assert.Equal(t, record.SkipReason, "")
+	}
+	due, err := ds.DueRecords(context.Background(), time.Now(), 10)
+	assert.NilError(t, err)
+	assert.Equal(t, len(due), 0)
+	// posts saved with the CID as the ID and the at-uri as the URL are fixed
+	record, err := ds.GetRecord(context.Background(), "posted")
+	assert.NilError(t, err)
+	assert.Equal(t, record.TargetPostID, "at://did:plc:me/app.bsky.feed.post/3kj2tj5zmqc2x")
+	assert.Equal(t, record.TargetPostCID, "bafyreicid")
+	assert.Equal(t, record.TargetPostRkey, "3kj2tj5zmqc2x")
+	assert.Equal(t, record.TargetPostURL, "https://bsky.app/profile/did:plc:me/post/3kj2tj5zmqc2x")
+	record, err = ds.GetRecord(context.Background(), "failed")
+	assert.NilError(t, err)
+	assert.Equal(t, record.TargetPostID, "")
+	assert.Equal(t, record.TargetPostURL, "")
+	// toots crossposted before there were targets have their post as one
+	targets, err := ds.ListTargets(context.Background(), "posted")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, targets, []Target{{
+		SourcePostID: "posted",
+		Role:         RoleRoot,
+		URI:          "at://did:plc:me/app.bsky.feed.post/3kj2tj5zmqc2x",
+		CID:          "bafyreicid",
+		Rkey:         "3kj2tj5zmqc2x",
+	}})
+	targets, err = ds.ListTargets(context.Background(), "failed")
+	assert.NilError(t, err)
+	assert.Equal(t, len(targets), 0)
+	// the later tables work
+	assert.NilError(t, ds.SetCheckpoint(context.Background(), "source", "1"))
+	assert.NilError(t, ds.AddAttempt(context.Background(), Attempt{SourcePostID: "failed", Attempt: 2, Stage: StagePost}))
+
+	// opening it again doesn't migrate again
+	_, err = OpenDatastore(path)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, appliedVersions(t, path), allVersions(t))
+}
+
+func TestMigrateAdoptsLegacySchema(t *testing.T) {
+	migrations, err := loadMigrations(sqliteDialect)
+	assert.NilError(t, err)
+	// a database that the ad-hoc migrations had taken as far as the
+	// checkpoint table
+	path := fmt.Sprintf("%s/sync.db", t.TempDir())
+	legacyDatabase(t, path, migrations[0].SQL, migrations[1].SQL, migrations[2].SQL,
+		`INSERT INTO sync_record (source_post_id, source_post_url, target_post_id, target_post_url, added_at, skip_reason) VALUES ('skipped', 'https://example.com/4', '', '', '2024-01-20 12:00:00', 'private')`)
+
+	ds, err := OpenDatastore(path)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, appliedVersions(t, path), allVersions(t))
+	record, err := ds.GetRecord(context.Background(), "skipped")
+	assert.NilError(t, err)
+	assert.Equal(t, record.State, StateSkipped)
+}
+
+func TestMigrateNewDatabase(t *testing.T) {
+	path := fmt.Sprintf("%s/sync.db", t.TempDir())
+	_, err := SchemaStatus(context.Background(), path)
+	assert.Assert(t, os.IsNotExist(err), "status shouldn't create the database")
+
+	_, err = CreateDatastore(path)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, appliedVersions(t, path), allVersions(t))
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(sqliteDialect)
+	assert.NilError(t, err)
+	assert.Equal(t, migrations[0].Version, 1)
+	assert.Equal(t, migrations[0].Name, "baseline")
+	for i, m := range migrations {
+		assert.Equal(t, m.Version, i+1)
+		assert.Assert(t, m.SQL != "", m.Name)
+	}
+}
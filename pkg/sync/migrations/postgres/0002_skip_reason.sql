@@ -0,0 +1 @@
+ALTER TABLE sync_record ADD COLUMN skip_reason TEXT DEFAULT '' NOT NULL;
@@ -0,0 +1 @@
+ALTER TABLE sync_record ADD COLUMN state TEXT DEFAULT 'pending' NOT NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE sync_record ADD COLUMN next_attempt_at TIMESTAMPTZ NULL;
+ALTER TABLE sync_record ADD COLUMN toot TEXT DEFAULT '' NOT NULL;
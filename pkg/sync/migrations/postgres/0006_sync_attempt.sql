@@ -0,0 +1,13 @@
+CREATE TABLE sync_attempt (
+	id BIGSERIAL PRIMARY KEY,
+	source_post_id TEXT NOT NULL,
+	attempt INT NOT NULL,
+	started_at TIMESTAMPTZ NOT NULL,
+	stage TEXT NOT NULL,
+	duration BIGINT NOT NULL,
+	error_class TEXT DEFAULT '' NOT NULL,
+	error TEXT DEFAULT '' NOT NULL,
+	target_post_uri TEXT DEFAULT '' NOT NULL,
+	target_post_cid TEXT DEFAULT '' NOT NULL
+);
+CREATE INDEX sync_attempt_source_post_id ON sync_attempt (source_post_id);
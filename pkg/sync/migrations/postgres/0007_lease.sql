@@ -0,0 +1,6 @@
+CREATE TABLE lease (
+	name TEXT PRIMARY KEY,
+	holder TEXT NOT NULL,
+	heartbeat TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);
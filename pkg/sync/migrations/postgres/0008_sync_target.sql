@@ -0,0 +1,15 @@
+CREATE TABLE sync_target (
+	source_post_id TEXT NOT NULL,
+	position INT NOT NULL,
+	role TEXT NOT NULL,
+	uri TEXT NOT NULL,
+	cid TEXT DEFAULT '' NOT NULL,
+	rkey TEXT DEFAULT '' NOT NULL,
+	PRIMARY KEY (source_post_id, position)
+);
+-- every toot crossposted so far is one post
+INSERT INTO sync_target (source_post_id, position, role, uri, cid, rkey)
+	SELECT source_post_id, 0, 'root', target_post_url, COALESCE(target_post_id, ''),
+		substr(target_post_url, strpos(target_post_url, '/app.bsky.feed.post/') + length('/app.bsky.feed.post/'))
+	FROM sync_record
+	WHERE state = 'posted' AND target_post_url LIKE 'at://%/app.bsky.feed.post/%';
@@ -0,0 +1,4 @@
+-- toots that failed before they were stored, which 0004 made
+-- failed-transient, can't be retried and have no next attempt to give up on
+UPDATE sync_record SET state = 'failed-permanent'
+	WHERE state = 'failed-transient' AND toot = '';
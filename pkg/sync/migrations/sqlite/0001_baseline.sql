@@ -0,0 +1,10 @@
+CREATE TABLE sync_record (
+	source_post_id TEXT PRIMARY KEY,
+	source_post_url TEXT,
+	target_post_id TEXT,
+	target_post_url TEXT,
+	added_at DATETIME NOT NULL,
+	synced_at DATETIME NULL,
+	attempts INT DEFAULT 0 NOT NULL,
+	last_error TEXT DEFAULT "" NOT NULL
+);
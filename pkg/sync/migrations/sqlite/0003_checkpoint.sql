@@ -0,0 +1,5 @@
+CREATE TABLE checkpoint (
+	source TEXT PRIMARY KEY,
+	status_id TEXT NOT NULL,
+	updated_at DATETIME NOT NULL
+);
@@ -0,0 +1,8 @@
+-- existing rows get the state their other columns say they're in
+ALTER TABLE sync_record ADD COLUMN state TEXT DEFAULT 'pending' NOT NULL;
+UPDATE sync_record SET state = CASE
+	WHEN skip_reason != '' THEN 'skipped'
+	WHEN synced_at IS NOT NULL AND target_post_id != '' THEN 'posted'
+	WHEN last_error != '' THEN 'failed-transient'
+	ELSE 'pending'
+END;
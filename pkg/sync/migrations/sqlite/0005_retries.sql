@@ -0,0 +1,2 @@
+ALTER TABLE sync_record ADD COLUMN next_attempt_at DATETIME NULL;
+ALTER TABLE sync_record ADD COLUMN toot TEXT DEFAULT "" NOT NULL;
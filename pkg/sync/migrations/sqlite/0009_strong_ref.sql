@@ -0,0 +1,13 @@
+ALTER TABLE sync_record ADD COLUMN target_post_cid TEXT DEFAULT "" NOT NULL;
+ALTER TABLE sync_record ADD COLUMN target_post_rkey TEXT DEFAULT "" NOT NULL;
+-- posts used to be saved with the CID as the ID and the at-uri as the URL.
+-- The handle isn't known here, but bsky.app takes the DID instead.
+UPDATE sync_record SET
+	target_post_id = target_post_url,
+	target_post_cid = COALESCE(target_post_id, ''),
+	target_post_rkey = substr(target_post_url, instr(target_post_url, '/app.bsky.feed.post/') + length('/app.bsky.feed.post/')),
+	target_post_url = 'https://bsky.app/profile/'
+		|| substr(target_post_url, length('at://') + 1, instr(target_post_url, '/app.bsky.feed.post/') - length('at://') - 1)
+		|| '/post/'
+		|| substr(target_post_url, instr(target_post_url, '/app.bsky.feed.post/') + length('/app.bsky.feed.post/'))
+	WHERE target_post_url LIKE 'at://%/app.bsky.feed.post/%';
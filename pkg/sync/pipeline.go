@@ -0,0 +1,288 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/willgorman/mastodon-bsky/pkg/bsky"
+	"github.com/willgorman/mastodon-bsky/pkg/mastodon"
+)
+
+// PipelineConfig sizes the stages toots go through.  Converting, which
+// includes downloading images, happens in parallel for any toots.  Posting
+// is spread over lanes by account, and each lane posts in the order the
+// source gave the toots, so an account's posts and threads stay in order.
+type PipelineConfig struct {
+	// Converters is how many toots are converted at once
+	Converters int `mapstructure:"converters"`
+	// Posters is how many lanes post at once
+	Posters int `mapstructure:"posters"`
+	// Queue is how many toots can wait for each stage before the source
+	// has to wait for them
+	Queue int `mapstructure:"queue"`
+}
+
+var DefaultPipelineConfig = PipelineConfig{
+	Converters: 4,
+	Posters:    2,
+	Queue:      8,
+}
+
+// withDefaults fills in what isn't set from DefaultPipelineConfig
+func (c PipelineConfig) withDefaults() PipelineConfig {
+	if c.Converters <= 0 {
+		c.Converters = DefaultPipelineConfig.Converters
+	}
+	if c.Posters <= 0 {
+		c.Posters = DefaultPipelineConfig.Posters
+	}
+	if c.Queue <= 0 {
+		c.Queue = DefaultPipelineConfig.Queue
+	}
+	return c
+}
+
+// task is a toot on its way through the pipeline
+type task struct {
+	record *SyncRecord
+	toot   mastodon.Status
+	// after is the task of the toot this one replies to, if that was
+	// still in the pipeline, which has to be posted first
+	after *task
+	// converted gets the post, or nil if the toot is finished with before
+	// posting
+	converted chan conversion
+	started   time.Time
+	// err is the error that stopped the pipeline while working on the
+	// toot, only set by its lane
+	err error
+	// done is closed once the toot has been handled
+	done chan struct{}
+}
+
+// conversion is what converting a toot came to
+type conversion struct {
+	post *bsky.Post
+	err  error
+}
+
+// finished is a task for a toot that didn't need to go through the
+// pipeline
+func finished(toot mastodon.Status) *task {
+	t := &task{toot: toot, done: make(chan struct{})}
+	close(t.done)
+	return t
+}
+
+// pipeline runs the stages for a processor.  Only Run sends it tasks.
+type pipeline struct {
+	p       *processor
+	convert chan *task
+	lanes   []chan *task
+	// checkpoints are the new toots in the order they came from the source
+	checkpoints chan *task
+
+	mu sync.Mutex
+	// inFlight are the tasks by source post ID
+	inFlight map[string]*task
+
+	wg      sync.WaitGroup
+	errOnce sync.Once
+	err     error
+	// failed is closed when a datastore error stops the pipeline
+	failed chan struct{}
+	cancel context.CancelFunc
+}
+
+func (p *processor) startPipeline(ctx context.Context, cancel context.CancelFunc) *pipeline {
+	cfg := p.config.Pipeline
+	pl := &pipeline{
+		p:           p,
+		convert:     make(chan *task, cfg.Queue),
+		checkpoints: make(chan *task, cfg.Queue*cfg.Posters),
+		inFlight:    map[string]*task{},
+		failed:      make(chan struct{}),
+		cancel:      cancel,
+	}
+	for i := 0; i < cfg.Converters; i++ {
+		pl.wg.Add(1)
+		go pl.converter(ctx)
+	}
+	for i := 0; i < cfg.Posters; i++ {
+		lane := make(chan *task, cfg.Queue)
+		pl.lanes = append(pl.lanes, lane)
+		pl.wg.Add(1)
+		go pl.poster(ctx, lane)
+	}
+	pl.wg.Add(1)
+	go pl.checkpointer(ctx)
+	return pl
+}
+
+// stop waits for the toots already in the pipeline, and returns the error
+// that stopped it or else err
+func (pl *pipeline) stop(err error) error {
+	close(pl.convert)
+	for _, lane := range pl.lanes {
+		close(lane)
+	}
+	close(pl.checkpoints)
+	pl.wg.Wait()
+	if pl.err != nil {
+		return pl.err
+	}
+	return err
+}
+
+// fail stops the pipeline for the first datastore error
+func (pl *pipeline) fail(err error) {
+	pl.errOnce.Do(func() {
+		pl.err = err
+		close(pl.failed)
+		pl.cancel()
+	})
+}
+
+// submit sends a toot with a record that's ready to be attempted into the
+// pipeline.  It waits while the stages are full, so the source can't get
+// ahead of the sink.
+func (pl *pipeline) submit(ctx context.Context, record *SyncRecord, toot mastodon.Status) (*task, error) {
+	t := &task{
+		record:    record,
+		toot:      toot,
+		converted: make(chan conversion, 1),
+		done:      make(chan struct{}),
+	}
+	pl.mu.Lock()
+	if parent := replyTo(toot); parent != "" {
+		t.after = pl.inFlight[parent]
+	}
+	pl.inFlight[record.SourcePostID] = t
+	pl.mu.Unlock()
+
+	// converting never waits on posting, so a lane that's waiting for a
+	// conversion always gets it
+	select {
+	case pl.convert <- t:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case pl.lanes[pl.lane(toot)] <- t:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return t, nil
+}
+
+// checkpoint moves the checkpoint to the toot once it and every toot
+// before it have been handled
+func (pl *pipeline) checkpoint(ctx context.Context, t *task) error {
+	select {
+	case pl.checkpoints <- t:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// running returns the task for the toot if it's in the pipeline
+func (pl *pipeline) running(sourcePostID string) *task {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return pl.inFlight[sourcePostID]
+}
+
+// lane is where the toot is posted, the same for every toot of an account
+func (pl *pipeline) lane(toot mastodon.Status) int {
+	h := fnv.New32a()
+	h.Write([]byte(toot.Account.ID))
+	return int(h.Sum32() % uint32(len(pl.lanes)))
+}
+
+func (pl *pipeline) converter(ctx context.Context) {
+	defer pl.wg.Done()
+	for t := range pl.convert {
+		if err := ctx.Err(); err != nil {
+			t.converted <- conversion{err: err}
+			continue
+		}
+		post, err := pl.p.convert(ctx, t)
+		if err != nil && ctx.Err() == nil {
+			pl.fail(err)
+		}
+		t.converted <- conversion{post: post, err: err}
+	}
+}
+
+func (pl *pipeline) poster(ctx context.Context, lane <-chan *task) {
+	defer pl.wg.Done()
+	for t := range lane {
+		if err := pl.post(ctx, t); err != nil {
+			t.err = err
+			if ctx.Err() == nil {
+				pl.fail(err)
+			}
+		}
+		pl.mu.Lock()
+		delete(pl.inFlight, t.record.SourcePostID)
+		pl.mu.Unlock()
+		close(t.done)
+	}
+}
+
+func (pl *pipeline) post(ctx context.Context, t *task) error {
+	var converted conversion
+	select {
+	case converted = <-t.converted:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if converted.post == nil {
+		return converted.err
+	}
+	if t.after != nil {
+		select {
+		case <-t.after.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return pl.p.post(ctx, t, converted.post)
+}
+
+func (pl *pipeline) checkpointer(ctx context.Context) {
+	defer pl.wg.Done()
+	stopped := false
+	for t := range pl.checkpoints {
+		select {
+		case <-t.done:
+		case <-ctx.Done():
+			stopped = true
+			continue
+		}
+		// a toot that wasn't handled has to be read again next time
+		if stopped || t.err != nil || ctx.Err() != nil {
+			stopped = true
+			continue
+		}
+		if err := pl.p.data.SetCheckpoint(ctx, pl.p.config.SourceID, string(t.toot.ID)); err != nil {
+			stopped = true
+			pl.fail(err)
+		}
+	}
+}
+
+// replyTo is the ID of the status a toot replies to, or ""
+func replyTo(toot mastodon.Status) string {
+	if toot.InReplyToID == nil {
+		return ""
+	}
+	return fmt.Sprint(toot.InReplyToID)
+}
@@ -0,0 +1,164 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gomastodon "github.com/mattn/go-mastodon"
+	"github.com/willgorman/mastodon-bsky/pkg/bsky"
+	"github.com/willgorman/mastodon-bsky/pkg/mastodon"
+	"gotest.tools/assert"
+)
+
+// lockedSink is a testSink that can be posted to from several lanes
+type lockedSink struct {
+	testSink
+	mu sync.Mutex
+	// gate holds up posting until it's closed, if it's set
+	gate chan struct{}
+}
+
+func (s *lockedSink) Post(ctx context.Context, post bsky.Post) (*bsky.PostResult, error) {
+	if s.gate != nil {
+		select {
+		case <-s.gate:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.testSink.Post(ctx, post)
+}
+
+func (s *lockedSink) posted() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return postedText(&s.testSink)
+}
+
+func tootBy(account, id string, replyTo string) mastodon.Status {
+	toot := mastodon.Status{Status: gomastodon.Status{
+		ID:         gomastodon.ID(id),
+		Visibility: gomastodon.VisibilityPublic,
+		Account:    gomastodon.Account{ID: gomastodon.ID(account)},
+	}}
+	if replyTo != "" {
+		toot.InReplyToID = replyTo
+	}
+	return toot
+}
+
+func TestPipelineOrdering(t *testing.T) {
+	var toots []mastodon.Status
+	for i := 0; i < 30; i++ {
+		toots = append(toots, tootBy(fmt.Sprint(i%3), fmt.Sprintf("%02d", i), ""))
+	}
+	// a reply to another account's toot, which could be in another lane
+	toots = append(toots, tootBy("3", "30", "29"))
+
+	sink := &lockedSink{}
+	p := newTestProcessor(t, &testSource{toots: toots}, sink, Config{
+		SourceID: "https://example.com/tags/bsky",
+		Pipeline: PipelineConfig{Converters: 8, Posters: 4, Queue: 4},
+	})
+	var converting, most atomic.Int32
+	p.transform = func(toot *mastodon.Status) (*bsky.Post, error) {
+		n := converting.Add(1)
+		defer converting.Add(-1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+		// the earlier toots take longer, so they finish out of order
+		var i int
+		fmt.Sscan(string(toot.ID), &i)
+		time.Sleep(time.Duration(30-i%30) * time.Millisecond / 10)
+		return testTransform(toot)
+	}
+	err := p.Run(context.Background())
+	assert.Assert(t, errors.Is(err, errSourceDone))
+	assert.Assert(t, most.Load() > 1, "toots were converted one at a time")
+
+	posted := sink.posted()
+	assert.Equal(t, len(posted), len(toots))
+	index := map[string]int{}
+	for i, id := range posted {
+		index[id] = i
+	}
+	// every account's toots were posted in order
+	for i := 3; i < 30; i++ {
+		id, before := fmt.Sprintf("%02d", i), fmt.Sprintf("%02d", i-3)
+		assert.Assert(t, index[before] < index[id], "%s posted before %s: %v", id, before, posted)
+	}
+	assert.Assert(t, index["29"] < index["30"], "reply posted before its parent: %v", posted)
+
+	checkpoint, err := p.data.GetCheckpoint(context.Background(), "https://example.com/tags/bsky")
+	assert.NilError(t, err)
+	assert.Equal(t, checkpoint, "30")
+}
+
+// countingSource counts the toots taken from it
+type countingSource struct {
+	toots []mastodon.Status
+	taken atomic.Int32
+}
+
+func (s *countingSource) Open(ctx context.Context) (<-chan mastodon.Status, <-chan error) {
+	toots := make(chan mastodon.Status)
+	go func() {
+		for _, toot := range s.toots {
+			select {
+			case toots <- toot:
+				s.taken.Add(1)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return toots, make(chan error)
+}
+
+func TestPipelineBackpressure(t *testing.T) {
+	var toots []mastodon.Status
+	for i := 0; i < 100; i++ {
+		toots = append(toots, tootBy("me", fmt.Sprint(i), ""))
+	}
+	source := &countingSource{toots: toots}
+	sink := &lockedSink{gate: make(chan struct{})}
+	cfg := PipelineConfig{Converters: 2, Posters: 1, Queue: 2}
+	p := newTestProcessor(t, source, sink, Config{
+		SourceID: "https://example.com/@me",
+		Pipeline: cfg,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- p.Run(ctx) }()
+
+	// with the sink stuck the source is only read as far as the lanes
+	// hold, the one being posted and the one waiting to get in
+	time.Sleep(100 * time.Millisecond)
+	limit := int32(cfg.Posters*(cfg.Queue+1) + 1)
+	assert.Assert(t, source.taken.Load() <= limit, "took %d toots with the sink stuck", source.taken.Load())
+	checkpoint, err := p.data.GetCheckpoint(ctx, "https://example.com/@me")
+	assert.NilError(t, err)
+	assert.Equal(t, checkpoint, "", "checkpoint moved past toots that weren't posted")
+
+	close(sink.gate)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.posted()) < len(toots) {
+		if time.Now().After(deadline) {
+			t.Fatalf("only posted %d toots", len(sink.posted()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	for i, text := range sink.posted() {
+		assert.Equal(t, text, fmt.Sprint(i))
+	}
+}
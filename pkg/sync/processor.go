@@ -3,10 +3,13 @@ package sync
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"time"
 
+	gomastodon "github.com/mattn/go-mastodon"
 	"github.com/willgorman/mastodon-bsky/pkg/bsky"
 	"github.com/willgorman/mastodon-bsky/pkg/mastodon"
 )
@@ -21,67 +24,388 @@ type bskySink interface {
 
 type transform func(toot *mastodon.Status) (*bsky.Post, error)
 
+type Config struct {
+	// Visibility is the set of toot visibilities that will be crossposted
+	Visibility VisibilityPolicy
+	// RestrictUnlisted adds a threadgate to posts from unlisted toots so
+	// nobody can reply to them
+	RestrictUnlisted bool
+	// Filter decides which of the toots from the source are crossposted
+	Filter mastodon.Filter
+	// Translation configures how toots are converted to posts
+	Translation bsky.TranslatorConfig
+	// SourceID is the key the checkpoint for the source is stored under
+	SourceID string
+	// Retry decides when toots that failed are tried again
+	Retry RetryPolicy
+	// Pipeline sizes the stages toots go through
+	Pipeline PipelineConfig
+}
+
 type processor struct {
-	data      *Datastore
+	data      Store
 	source    mastodonSource
 	sink      bskySink
 	transform transform
+	config    Config
+	// now is the time retries are scheduled and found due by
+	now func() time.Time
 }
 
-func New(data *Datastore, source mastodonSource, sink bskySink) *processor {
+func New(data Store, source mastodonSource, sink bskySink, cfg Config) *processor {
+	cfg.Retry = cfg.Retry.withDefaults()
+	cfg.Pipeline = cfg.Pipeline.withDefaults()
+	translator := bsky.NewTranslator(cfg.Translation)
 	return &processor{
 		data:   data,
 		source: source,
 		sink:   sink,
+		transform: func(toot *mastodon.Status) (*bsky.Post, error) {
+			return translator.ConvertText(&toot.Status, toot.Text)
+		},
+		config: cfg,
+		now:    time.Now,
 	}
 }
 
+// clockID is the TID clock ID for an account, which has to fit in 10 bits
+func clockID(account string) uint {
+	h := fnv.New32a()
+	h.Write([]byte(account))
+	return uint(h.Sum32() % 1024)
+}
+
+// recordKey is the rkey for the post of a toot.  Every attempt gets the same
+// key so a toot that was posted but not recorded as posted isn't posted
+// again.  The clock ID is from the toot's author, so toots by different
+// accounts made at the same time don't get the same key, and it doesn't
+// change when the source follows the account to where it moved.
+func (p *processor) recordKey(toot mastodon.Status, addedAt time.Time) string {
+	createdAt := toot.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = addedAt
+	}
+	author := toot.Account.URL
+	if author == "" {
+		author = p.config.SourceID
+	}
+	return bsky.RecordKey(createdAt, string(toot.ID), clockID(author))
+}
+
+// retryBatch is how many due retries are attempted each Retry.Interval,
+// so retries don't hold up new toots for long
+const retryBatch = 10
+
 func (p *processor) Run(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
-	toots, errors := p.source.Open(ctx)
 	defer cancel()
-	for {
-		select {
-		case toot := <-toots:
-			// TODO: (willgorman)
-			// add to database
-			record := SyncRecord{
-				AddedAt:       time.Now(),
-				SourcePostID:  string(toot.ID),
-				SourcePostURL: toot.URI,
-			}
-			if err := p.data.CreateRecord(ctx, record); err != nil {
-				return fmt.Errorf("could not create sync record: %w", err)
-			}
-			log.Println(toot.Content)
-			// convert
-			post, err := p.transform(&toot)
-			if err != nil {
-				// TODO: (willgorman) error handling to retry on http.Get errors?
-				err = fmt.Errorf("could not convert: %w", err)
-				record.LastError = err.Error()
+	pl := p.startPipeline(ctx, cancel)
+	toots, errs := p.source.Open(ctx)
+	retry := time.NewTicker(p.config.Retry.Interval)
+	defer retry.Stop()
+	err := func() error {
+		// toots the last run was in the middle of are retried first, the
+		// source has already moved on from them
+		recovered, err := p.data.RecoverInterrupted(ctx, p.now())
+		if err != nil {
+			return err
+		}
+		if recovered > 0 {
+			log.Printf("retrying %d toots that were interrupted", recovered)
+			if err := p.retryDue(ctx, pl); err != nil {
 				return err
 			}
-
-			// send to sink
-			result, err := p.sink.Post(ctx, *post)
-			if err != nil {
-				// TODO: (willgorman) retries but don't spam
-				return fmt.Errorf("posting to bluesky: %w", err)
+		}
+		for {
+			select {
+			case toot, ok := <-toots:
+				if !ok {
+					return ctx.Err()
+				}
+				if err := p.process(ctx, pl, toot); err != nil {
+					return err
+				}
+			case <-retry.C:
+				if err := p.retryDue(ctx, pl); err != nil {
+					return err
+				}
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				if !sourceRecovers(err) {
+					return err
+				}
+				log.Printf("source: %s", err)
+			case <-pl.failed:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
 			}
+		}
+	}()
+	return pl.stop(err)
+}
 
-			record.SyncedAt = sql.NullTime{Time: time.Now(), Valid: true}
-			record.TargetPostID = result.Cid
-			record.TargetPostURL = result.Uri
-			err = p.data.UpdateRecord(ctx, record)
-			if err != nil {
-				return fmt.Errorf("failed to update after sync: %w", err)
-			}
+// process starts a toot on its way through the pipeline, or handles it
+// here if it doesn't need to go through it.
+func (p *processor) process(ctx context.Context, pl *pipeline, toot mastodon.Status) error {
+	if toot.Event == mastodon.EventDelete {
+		return p.deleted(ctx, pl, toot)
+	}
+	if !toot.IsNew() {
+		// TODO: (willgorman) bluesky posts can't be edited
+		log.Printf("ignoring %s event for toot %s", toot.Event, toot.ID)
+		return nil
+	}
+	t, err := p.start(ctx, pl, toot)
+	if err != nil {
+		return err
+	}
+	if p.config.SourceID != "" {
+		return pl.checkpoint(ctx, t)
+	}
+	return nil
+}
 
-		case err := <-errors:
+// start creates the record for a new toot and submits it, unless it's
+// skipped or already has a record
+func (p *processor) start(ctx context.Context, pl *pipeline, toot mastodon.Status) (*task, error) {
+	if t := pl.running(string(toot.ID)); t != nil {
+		// being retried, the checkpoint has to wait for it
+		return t, nil
+	}
+	_, err := p.data.GetRecord(ctx, string(toot.ID))
+	switch {
+	case err == nil:
+		log.Printf("already have a record for toot %s", toot.ID)
+		return finished(toot), nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, fmt.Errorf("could not get sync record: %w", err)
+	}
+	record := SyncRecord{
+		AddedAt:       time.Now(),
+		SourcePostID:  string(toot.ID),
+		SourcePostURL: toot.URI,
+		State:         StatePending,
+	}
+	if reason, skip := p.skip(&toot); skip {
+		log.Printf("skipping toot %s: %s", toot.ID, reason)
+		record.SkipReason = reason
+		record.State = StateSkipped
+		if err := p.data.CreateRecord(ctx, record); err != nil {
+			return nil, fmt.Errorf("could not create sync record: %w", err)
+		}
+		return finished(toot), nil
+	}
+	stored, err := storeToot(toot)
+	if err != nil {
+		return nil, err
+	}
+	record.Toot = stored
+	if err := p.data.CreateRecord(ctx, record); err != nil {
+		return nil, fmt.Errorf("could not create sync record: %w", err)
+	}
+	log.Println(toot.Content)
+	return pl.submit(ctx, &record, toot)
+}
+
+// convert translates the toot of a pending or failed record to a post.
+// A failure is recorded on the record and returns a nil post, only
+// datastore errors are returned.
+func (p *processor) convert(ctx context.Context, t *task) (*bsky.Post, error) {
+	record, toot := t.record, t.toot
+	if err := p.data.Transition(ctx, record, StateConverting); err != nil {
+		return nil, err
+	}
+	t.started = time.Now()
+	post, err := p.transform(&toot)
+	if err != nil {
+		if err := p.addAttempt(ctx, record, t.started, failedStage(err, false), nil, err); err != nil {
+			return nil, err
+		}
+		return nil, p.fail(ctx, record, fmt.Errorf("could not convert: %w", err), transient(err, false))
+	}
+	if toot.Visibility == gomastodon.VisibilityUnlisted && p.config.RestrictUnlisted {
+		post.RestrictReplies = true
+	}
+	post.Rkey = p.recordKey(toot, record.AddedAt)
+	post.SourceURL = record.SourcePostURL
+	return post, nil
+}
+
+// post sends a converted toot to bluesky.  Like convert, failures are
+// recorded on the record instead of returned.
+func (p *processor) post(ctx context.Context, t *task, post *bsky.Post) error {
+	record := t.record
+	if err := p.data.Transition(ctx, record, StatePosting); err != nil {
+		return err
+	}
+	result, err := p.sink.Post(ctx, *post)
+	if err := p.addAttempt(ctx, record, t.started, failedStage(err, true), result, err); err != nil {
+		return err
+	}
+	if result != nil {
+		if err := p.setTarget(ctx, record, result); err != nil {
 			return err
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("posting to bluesky: %w", err)
+		if authExpired(err) {
+			return p.stopFor(ctx, record, err)
+		}
+		// the post was made but something after it wasn't, posting again
+		// finds it by its rkey and finishes the rest
+		return p.fail(ctx, record, err, result != nil || transient(err, true))
+	}
+
+	record.LastError = ""
+	record.NextAttemptAt = sql.NullTime{}
+	if err := p.data.Transition(ctx, record, StatePosted); err != nil {
+		return fmt.Errorf("failed to update after sync: %w", err)
+	}
+	return nil
+}
+
+// setTarget saves the post a toot was crossposted as
+func (p *processor) setTarget(ctx context.Context, record *SyncRecord, result *bsky.PostResult) error {
+	targets := []Target{{Role: RoleRoot, URI: result.Uri, CID: result.Cid, Rkey: result.Rkey}}
+	if err := p.data.SetTargets(ctx, record.SourcePostID, targets); err != nil {
+		return fmt.Errorf("failed to save posts of %s: %w", record.SourcePostID, err)
+	}
+	record.TargetPostID = result.Uri
+	record.TargetPostCID = result.Cid
+	record.TargetPostRkey = result.Rkey
+	record.TargetPostURL = result.URL
+	return nil
+}
+
+// addAttempt saves the history of an attempt that got as far as stage
+func (p *processor) addAttempt(ctx context.Context, record *SyncRecord, started time.Time, stage Stage, result *bsky.PostResult, err error) error {
+	attempt := Attempt{
+		SourcePostID: record.SourcePostID,
+		Attempt:      record.Attempts,
+		StartedAt:    started,
+		Stage:        stage,
+		Duration:     time.Since(started),
+		ErrorClass:   errorClass(err),
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	if result != nil {
+		attempt.TargetPostURI = result.Uri
+		attempt.TargetPostCID = result.Cid
+	}
+	return p.data.AddAttempt(ctx, attempt)
+}
+
+// fail records the error that stopped a toot from being crossposted and
+// schedules the next attempt, or gives up on the toot if the error won't
+// go away or it has run out of attempts.
+func (p *processor) fail(ctx context.Context, record *SyncRecord, err error, transient bool) error {
+	record.LastError = err.Error()
+	record.NextAttemptAt = sql.NullTime{}
+	to := StateFailedPermanent
+	switch {
+	case !transient:
+		log.Printf("giving up on toot %s: %s", record.SourcePostID, err)
+	case record.Attempts >= p.config.Retry.MaxAttempts:
+		record.LastError = fmt.Sprintf("gave up after %d attempts: %s", record.Attempts, err)
+		log.Printf("giving up on toot %s after %d attempts: %s", record.SourcePostID, record.Attempts, err)
+	default:
+		to = StateFailedTransient
+		next := p.now().Add(p.config.Retry.Backoff(record.Attempts)).UTC()
+		record.NextAttemptAt = sql.NullTime{Time: next, Valid: true}
+		log.Printf("retrying toot %s at %s: %s", record.SourcePostID, next, err)
+	}
+	return p.data.Transition(ctx, record, to)
+}
+
+// stopFor stops the run for an error every toot would get, like bluesky
+// not taking the session even after refreshing it.  The toot is tried again
+// as soon as the next run starts, instead of being given up on.
+func (p *processor) stopFor(ctx context.Context, record *SyncRecord, err error) error {
+	record.LastError = err.Error()
+	record.NextAttemptAt = sql.NullTime{Time: p.now().UTC(), Valid: true}
+	if err := p.data.Transition(ctx, record, StateFailedTransient); err != nil {
+		return err
+	}
+	log.Printf("stopping at toot %s: %s", record.SourcePostID, err)
+	return err
+}
+
+// retryDue submits the failed toots that are due another try
+func (p *processor) retryDue(ctx context.Context, pl *pipeline) error {
+	records, err := p.data.DueRecords(ctx, p.now(), retryBatch)
+	if err != nil {
+		return err
+	}
+	for i := range records {
+		record := &records[i]
+		if pl.running(record.SourcePostID) != nil {
+			continue
+		}
+		toot, err := loadToot(record.Toot)
+		if err != nil {
+			// records from before toots were stored can't be retried
+			record.LastError = err.Error()
+			if err := p.data.Transition(ctx, record, StateFailedPermanent); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := pl.submit(ctx, record, toot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleted stops a toot that was deleted before it was crossposted from
+// being tried again.  A toot that's in the pipeline is finished with
+// first.
+func (p *processor) deleted(ctx context.Context, pl *pipeline, toot mastodon.Status) error {
+	if t := pl.running(string(toot.ID)); t != nil {
+		select {
+		case <-t.done:
 		case <-ctx.Done():
 			return ctx.Err()
 		}
 	}
+	record, err := p.data.GetRecord(ctx, string(toot.ID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not get sync record: %w", err)
+	}
+	if !record.State.CanTransition(StateDeleted) {
+		// TODO: (willgorman) delete the bluesky post too
+		log.Printf("ignoring delete of %s toot %s", record.State, toot.ID)
+		return nil
+	}
+	return p.data.Transition(ctx, record, StateDeleted)
+}
+
+// skip returns the reason a toot should not be crossposted
+func (p *processor) skip(toot *mastodon.Status) (string, bool) {
+	if !p.config.Visibility.Allows(toot.Visibility) {
+		return fmt.Sprintf("visibility %q is not allowed", toot.Visibility), true
+	}
+	text := toot.Text
+	if text == "" {
+		content := toot.Content
+		if toot.Reblog != nil {
+			// the directives of the boosted toot's author
+			content = toot.Reblog.Content
+		}
+		text = mastodon.PlainText(content)
+	}
+	if reason, skip := p.config.Translation.Directives.Skip(text); skip {
+		return reason, true
+	}
+	return p.config.Filter.Skip(toot, time.Now())
 }
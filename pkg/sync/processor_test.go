@@ -0,0 +1,677 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+	gomastodon "github.com/mattn/go-mastodon"
+	"github.com/willgorman/mastodon-bsky/pkg/bsky"
+	"github.com/willgorman/mastodon-bsky/pkg/mastodon"
+	"github.com/willgorman/mastodon-bsky/pkg/remote"
+	"gotest.tools/assert"
+)
+
+var errSourceDone = errors.New("source done")
+
+// testSource sends errs and then toots, and then errSourceDone
+type testSource struct {
+	errs  []error
+	toots []mastodon.Status
+}
+
+func (s *testSource) Open(ctx context.Context) (<-chan mastodon.Status, <-chan error) {
+	toots := make(chan mastodon.Status)
+	errs := make(chan error)
+	go func() {
+		for _, err := range s.errs {
+			select {
+			case errs <- err:
+			case <-ctx.Done():
+				return
+			}
+		}
+		for _, toot := range s.toots {
+			select {
+			case toots <- toot:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case errs <- errSourceDone:
+		case <-ctx.Done():
+		}
+	}()
+	return toots, errs
+}
+
+type testSink struct {
+	posts []bsky.Post
+}
+
+func (s *testSink) Post(ctx context.Context, post bsky.Post) (*bsky.PostResult, error) {
+	s.posts = append(s.posts, post)
+	n := len(s.posts)
+	return &bsky.PostResult{
+		Cid:  fmt.Sprintf("cid%d", n),
+		Uri:  fmt.Sprintf("at://did:plc:test/app.bsky.feed.post/%d", n),
+		Rkey: fmt.Sprint(n),
+		URL:  bsky.PostURL("test.bsky.social", fmt.Sprint(n)),
+	}, nil
+}
+
+func testTransform(toot *mastodon.Status) (*bsky.Post, error) {
+	post := &bsky.Post{}
+	post.Text = string(toot.ID)
+	return post, nil
+}
+
+func newTestProcessor(t *testing.T, source mastodonSource, sink bskySink, cfg Config) *processor {
+	t.Helper()
+	data, err := CreateDatastore(fmt.Sprintf("%s/sync.db", t.TempDir()))
+	assert.NilError(t, err)
+	p := New(data, source, sink, cfg)
+	p.transform = testTransform
+	return p
+}
+
+func tootsWithVisibility(visibilities ...string) []mastodon.Status {
+	var toots []mastodon.Status
+	for i, v := range visibilities {
+		toots = append(toots, mastodon.Status{Status: gomastodon.Status{
+			ID:         gomastodon.ID(fmt.Sprintf("%d-%s", i, v)),
+			Visibility: v,
+		}})
+	}
+	return toots
+}
+
+func postedText(sink *testSink) []string {
+	var text []string
+	for _, p := range sink.posts {
+		text = append(text, p.Text)
+	}
+	return text
+}
+
+func TestVisibilityPolicy(t *testing.T) {
+	all := []string{
+		gomastodon.VisibilityPublic,
+		gomastodon.VisibilityUnlisted,
+		gomastodon.VisibilityFollowersOnly,
+		gomastodon.VisibilityDirectMessage,
+		"",
+	}
+	tests := []struct {
+		name   string
+		policy VisibilityPolicy
+		want   []string
+	}{
+		{
+			name: "default is public only",
+			want: []string{"0-public"},
+		},
+		{
+			name:   "unlisted",
+			policy: VisibilityPolicy{gomastodon.VisibilityPublic, gomastodon.VisibilityUnlisted},
+			want:   []string{"0-public", "1-unlisted"},
+		},
+		{
+			name:   "private must be explicit",
+			policy: VisibilityPolicy{gomastodon.VisibilityFollowersOnly},
+			want:   []string{"2-private"},
+		},
+		{
+			name:   "direct is never posted",
+			policy: VisibilityPolicy{gomastodon.VisibilityDirectMessage, ""},
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &testSink{}
+			p := newTestProcessor(t, &testSource{toots: tootsWithVisibility(all...)}, sink, Config{Visibility: tt.policy})
+			err := p.Run(context.Background())
+			assert.Assert(t, errors.Is(err, errSourceDone))
+			assert.DeepEqual(t, postedText(sink), tt.want)
+		})
+	}
+}
+
+func TestParseVisibilityPolicy(t *testing.T) {
+	policy, err := ParseVisibilityPolicy(nil)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, policy, DefaultVisibilityPolicy)
+
+	policy, err = ParseVisibilityPolicy([]string{"public", "unlisted"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, policy, VisibilityPolicy{"public", "unlisted"})
+
+	_, err = ParseVisibilityPolicy([]string{"public", "direct"})
+	assert.ErrorContains(t, err, "can not be crossposted")
+
+	_, err = ParseVisibilityPolicy([]string{"everyone"})
+	assert.ErrorContains(t, err, "unknown visibility")
+}
+
+func TestRestrictUnlisted(t *testing.T) {
+	sink := &testSink{}
+	source := &testSource{toots: tootsWithVisibility(gomastodon.VisibilityPublic, gomastodon.VisibilityUnlisted)}
+	p := newTestProcessor(t, source, sink, Config{
+		Visibility:       VisibilityPolicy{gomastodon.VisibilityPublic, gomastodon.VisibilityUnlisted},
+		RestrictUnlisted: true,
+	})
+	err := p.Run(context.Background())
+	assert.Assert(t, errors.Is(err, errSourceDone))
+	assert.Equal(t, len(sink.posts), 2)
+	assert.Assert(t, !sink.posts[0].RestrictReplies)
+	assert.Assert(t, sink.posts[1].RestrictReplies)
+}
+
+func TestSkipRecordsReason(t *testing.T) {
+	sink := &testSink{}
+	toots := tootsWithVisibility(gomastodon.VisibilityPublic, gomastodon.VisibilityPublic, gomastodon.VisibilityDirectMessage)
+	toots[1].Language = "de"
+	p := newTestProcessor(t, &testSource{toots: toots}, sink, Config{
+		Filter: mastodon.Filter{Exclude: []mastodon.Rule{{Languages: []string{"de"}}}},
+	})
+	err := p.Run(context.Background())
+	assert.Assert(t, errors.Is(err, errSourceDone))
+	assert.DeepEqual(t, postedText(sink), []string{"0-public"})
+
+	record, err := p.data.GetRecord(context.Background(), "1-public")
+	assert.NilError(t, err)
+	assert.Equal(t, record.SkipReason, "excluded by rule: languages [de]")
+
+	record, err = p.data.GetRecord(context.Background(), "2-direct")
+	assert.NilError(t, err)
+	assert.Equal(t, record.SkipReason, `visibility "direct" is not allowed`)
+}
+
+func TestCheckpointAndDuplicates(t *testing.T) {
+	sink := &testSink{}
+	toots := tootsWithVisibility(gomastodon.VisibilityPublic, gomastodon.VisibilityPublic)
+	toots[0].ID = "100"
+	toots[1].ID = "101"
+	p := newTestProcessor(t, &testSource{toots: toots}, sink, Config{SourceID: "https://example.com/@me"})
+	err := p.Run(context.Background())
+	assert.Assert(t, errors.Is(err, errSourceDone))
+	assert.DeepEqual(t, postedText(sink), []string{"100", "101"})
+
+	checkpoint, err := p.data.GetCheckpoint(context.Background(), "https://example.com/@me")
+	assert.NilError(t, err)
+	assert.Equal(t, checkpoint, "101")
+
+	// reading the same toots again, like with an old --since, doesn't repost them
+	p.source = &testSource{toots: toots}
+	err = p.Run(context.Background())
+	assert.Assert(t, errors.Is(err, errSourceDone))
+	assert.Equal(t, len(sink.posts), 2)
+}
+
+func TestIgnoresEditsAndDeletes(t *testing.T) {
+	sink := &testSink{}
+	toots := tootsWithVisibility(gomastodon.VisibilityPublic, gomastodon.VisibilityPublic, gomastodon.VisibilityPublic)
+	toots[1].Event = mastodon.EventEdit
+	toots[2].Event = mastodon.EventDelete
+	p := newTestProcessor(t, &testSource{toots: toots}, sink, Config{SourceID: "https://example.com/@me"})
+	err := p.Run(context.Background())
+	assert.Assert(t, errors.Is(err, errSourceDone))
+	assert.DeepEqual(t, postedText(sink), []string{"0-public"})
+
+	records, err := p.data.ListRecords(context.Background())
+	assert.NilError(t, err)
+	assert.Equal(t, len(records), 1)
+	checkpoint, err := p.data.GetCheckpoint(context.Background(), "https://example.com/@me")
+	assert.NilError(t, err)
+	assert.Equal(t, checkpoint, "0-public")
+}
+
+type failingSink struct {
+	err error
+}
+
+func (s *failingSink) Post(ctx context.Context, post bsky.Post) (*bsky.PostResult, error) {
+	return nil, s.err
+}
+
+func TestRecordStates(t *testing.T) {
+	ctx := context.Background()
+	toots := tootsWithVisibility(gomastodon.VisibilityPublic, gomastodon.VisibilityDirectMessage)
+	p := newTestProcessor(t, &testSource{toots: toots}, &testSink{}, Config{})
+	err := p.Run(ctx)
+	assert.Assert(t, errors.Is(err, errSourceDone))
+
+	record, err := p.data.GetRecord(ctx, "0-public")
+	assert.NilError(t, err)
+	assert.Equal(t, record.State, StatePosted)
+	assert.Equal(t, record.Attempts, 1)
+	assert.Equal(t, record.TargetPostID, "at://did:plc:test/app.bsky.feed.post/1")
+	assert.Equal(t, record.TargetPostCID, "cid1")
+	assert.Equal(t, record.TargetPostRkey, "1")
+	assert.Equal(t, record.TargetPostURL, "https://bsky.app/profile/test.bsky.social/post/1")
+	targets, err := p.data.ListTargets(ctx, "0-public")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, targets, []Target{{
+		SourcePostID: "0-public",
+		Role:         RoleRoot,
+		URI:          "at://did:plc:test/app.bsky.feed.post/1",
+		CID:          "cid1",
+		Rkey:         "1",
+	}})
+	record, err = p.data.GetRecord(ctx, "1-direct")
+	assert.NilError(t, err)
+	assert.Equal(t, record.State, StateSkipped)
+
+	// a failed post is recorded, and deleting its toot stops it being retried
+	failed := tootsWithVisibility(gomastodon.VisibilityPublic)
+	failed[0].ID = "2"
+	p.source = &testSource{toots: failed}
+	p.sink = &failingSink{err: errors.New("bluesky is down")}
+	err = p.Run(ctx)
+	assert.Assert(t, errors.Is(err, errSourceDone))
+	record, err = p.data.GetRecord(ctx, "2")
+	assert.NilError(t, err)
+	assert.Equal(t, record.State, StateFailedTransient)
+	assert.Equal(t, record.LastError, "posting to bluesky: bluesky is down")
+	targets, err = p.data.ListTargets(ctx, "2")
+	assert.NilError(t, err)
+	assert.Equal(t, len(targets), 0)
+	assert.Assert(t, record.NextAttemptAt.Time.After(time.Now()))
+
+	deleted := mastodon.Status{Event: mastodon.EventDelete}
+	deleted.ID = "2"
+	p.source = &testSource{toots: []mastodon.Status{deleted}}
+	err = p.Run(ctx)
+	assert.Assert(t, errors.Is(err, errSourceDone))
+	record, err = p.data.GetRecord(ctx, "2")
+	assert.NilError(t, err)
+	assert.Equal(t, record.State, StateDeleted)
+}
+
+func TestAuthExpiredStopsRun(t *testing.T) {
+	ctx := context.Background()
+	toots := []mastodon.Status{tootBy("me", "1", ""), tootBy("me", "2", "")}
+	p := newTestProcessor(t, &testSource{toots: toots}, &testSink{}, Config{SourceID: "https://example.com/@me"})
+	p.sink = &failingSink{err: fmt.Errorf("failed to post: %w", &remote.Error{
+		Service:    "bluesky",
+		Kind:       remote.AuthExpired,
+		StatusCode: http.StatusBadRequest,
+		Err:        errors.New("ExpiredToken: Token has expired"),
+	})}
+	err := p.Run(ctx)
+	assert.Assert(t, authExpired(err), "got %v", err)
+
+	// the toot isn't given up on, it's first in line for the next run
+	record, err := p.data.GetRecord(ctx, "1")
+	assert.NilError(t, err)
+	assert.Equal(t, record.State, StateFailedTransient)
+	assert.Assert(t, !record.NextAttemptAt.Time.After(time.Now()))
+	checkpoint, err := p.data.GetCheckpoint(ctx, "https://example.com/@me")
+	assert.NilError(t, err)
+	assert.Equal(t, checkpoint, "")
+
+	sink := &testSink{}
+	p.sink = sink
+	err = p.Run(ctx)
+	assert.Assert(t, errors.Is(err, errSourceDone))
+	assert.DeepEqual(t, postedText(sink), []string{"1", "2"})
+}
+
+func TestSourceErrors(t *testing.T) {
+	ctx := context.Background()
+	// a blip polling mastodon doesn't stop the run
+	source := &testSource{
+		errs: []error{&remote.Error{
+			Service:    "mastodon",
+			Kind:       remote.Upstream,
+			StatusCode: http.StatusBadGateway,
+			Err:        errors.New("unexpected status from /api/v1/accounts/1/statuses: 502 Bad Gateway"),
+		}},
+		toots: tootsWithVisibility(gomastodon.VisibilityPublic),
+	}
+	sink := &testSink{}
+	p := newTestProcessor(t, source, sink, Config{})
+	err := p.Run(ctx)
+	assert.Assert(t, errors.Is(err, errSourceDone), "got %v", err)
+	assert.DeepEqual(t, postedText(sink), []string{"0-public"})
+
+	// but the account moving does
+	moved := &mastodon.MovedError{}
+	p.source = &testSource{errs: []error{moved}, toots: tootsWithVisibility(gomastodon.VisibilityPublic)}
+	err = p.Run(ctx)
+	assert.Assert(t, errors.Is(err, moved), "got %v", err)
+}
+
+// partialSink makes the post but fails after it, like when the threadgate
+// isn't made
+type partialSink struct {
+	testSink
+	err error
+}
+
+func (s *partialSink) Post(ctx context.Context, post bsky.Post) (*bsky.PostResult, error) {
+	result, _ := s.testSink.Post(ctx, post)
+	return result, s.err
+}
+
+func TestPostedButFollowUpFailed(t *testing.T) {
+	ctx := context.Background()
+	toots := tootsWithVisibility(gomastodon.VisibilityPublic)
+	p := newTestProcessor(t, &testSource{toots: toots}, &partialSink{err: fmt.Errorf("failed to create threadgate: %w", &remote.Error{
+		Service:    "bluesky",
+		Kind:       remote.InvalidRequest,
+		StatusCode: http.StatusBadRequest,
+		Err:        errors.New("InvalidRecord"),
+	})}, Config{})
+	err := p.Run(ctx)
+	assert.Assert(t, errors.Is(err, errSourceDone))
+
+	// the post is kept and the toot is tried again to finish it
+	record, err := p.data.GetRecord(ctx, "0-public")
+	assert.NilError(t, err)
+	assert.Equal(t, record.State, StateFailedTransient)
+	assert.Equal(t, record.TargetPostID, "at://did:plc:test/app.bsky.feed.post/1")
+	assert.Equal(t, record.TargetPostRkey, "1")
+	assert.ErrorContains(t, errors.New(record.LastError), "failed to create threadgate")
+	targets, err := p.data.ListTargets(ctx, "0-public")
+	assert.NilError(t, err)
+	assert.Equal(t, len(targets), 1)
+	assert.Equal(t, targets[0].URI, record.TargetPostID)
+	attempts, err := p.data.ListAttempts(ctx, "0-public")
+	assert.NilError(t, err)
+	assert.Equal(t, len(attempts), 1)
+	assert.Equal(t, attempts[0].TargetPostURI, record.TargetPostID)
+}
+
+// openSource sends its toots and then stays open until ctx is done
+type openSource struct {
+	toots []mastodon.Status
+}
+
+func (s *openSource) Open(ctx context.Context) (<-chan mastodon.Status, <-chan error) {
+	toots := make(chan mastodon.Status)
+	go func() {
+		for _, toot := range s.toots {
+			select {
+			case toots <- toot:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return toots, make(chan error)
+}
+
+// flakySink fails to post a toot the number of times in failures, or
+// always with the error in permanent
+type flakySink struct {
+	testSink
+	mu        sync.Mutex
+	failures  map[string]int
+	permanent map[string]error
+	// rkeys are the record keys of every attempt
+	rkeys []string
+}
+
+func (s *flakySink) Post(ctx context.Context, post bsky.Post) (*bsky.PostResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rkeys = append(s.rkeys, post.Rkey)
+	if err, ok := s.permanent[post.Text]; ok {
+		return nil, err
+	}
+	if s.failures[post.Text] != 0 {
+		s.failures[post.Text]--
+		return nil, fmt.Errorf("post %s: %w", post.Text, errors.New("connection reset"))
+	}
+	return s.testSink.Post(ctx, post)
+}
+
+func (s *flakySink) posted() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return postedText(&s.testSink)
+}
+
+func TestRetries(t *testing.T) {
+	toots := tootsWithVisibility(gomastodon.VisibilityPublic, gomastodon.VisibilityPublic, gomastodon.VisibilityPublic, gomastodon.VisibilityPublic)
+	sink := &flakySink{
+		failures: map[string]int{"0-public": 2, "1-public": 100},
+		permanent: map[string]error{
+			"2-public": &xrpc.Error{StatusCode: http.StatusBadRequest, Wrapped: errors.New("invalid record")},
+		},
+	}
+	p := newTestProcessor(t, &testSource{toots: toots}, sink, Config{
+		Retry: RetryPolicy{
+			MaxAttempts: 3,
+			BaseDelay:   time.Minute,
+			MaxDelay:    time.Hour,
+			// retries are only attempted by the test
+			Interval: 24 * time.Hour,
+		},
+	})
+	clock := time.Now()
+	p.now = func() time.Time { return clock }
+	ctx := context.Background()
+	err := p.Run(ctx)
+	assert.Assert(t, errors.Is(err, errSourceDone))
+	// the toot after the failing ones wasn't held up by them
+	assert.DeepEqual(t, sink.posted(), []string{"3-public"})
+
+	// nothing is due until the backoff has passed
+	retry := func() {
+		t.Helper()
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		pl := p.startPipeline(ctx, cancel)
+		assert.NilError(t, pl.stop(p.retryDue(ctx, pl)))
+	}
+	retry()
+	assert.DeepEqual(t, sink.posted(), []string{"3-public"})
+	for i := 0; i < 2; i++ {
+		clock = clock.Add(2 * time.Hour)
+		retry()
+	}
+
+	want := map[string]State{
+		"0-public": StatePosted,
+		"1-public": StateFailedPermanent,
+		"2-public": StateFailedPermanent,
+		"3-public": StatePosted,
+	}
+	records, err := p.data.ListRecords(ctx)
+	assert.NilError(t, err)
+	got := map[string]State{}
+	for _, r := range records {
+		got[r.SourcePostID] = r.State
+	}
+	assert.DeepEqual(t, got, want)
+	assert.DeepEqual(t, sink.posted(), []string{"3-public", "0-public"})
+
+	record, err := p.data.GetRecord(ctx, "0-public")
+	assert.NilError(t, err)
+	assert.Equal(t, record.Attempts, 3)
+	assert.Equal(t, record.LastError, "")
+	record, err = p.data.GetRecord(ctx, "1-public")
+	assert.NilError(t, err)
+	assert.Equal(t, record.Attempts, 3)
+	assert.ErrorContains(t, errors.New(record.LastError), "gave up after 3 attempts")
+	record, err = p.data.GetRecord(ctx, "2-public")
+	assert.NilError(t, err)
+	assert.Equal(t, record.Attempts, 1)
+	assert.ErrorContains(t, errors.New(record.LastError), "invalid record")
+
+	// every attempt is in the history
+	attempts, err := p.data.ListAttempts(ctx, "0-public")
+	assert.NilError(t, err)
+	assert.Equal(t, len(attempts), 3)
+	for i, a := range attempts {
+		assert.Equal(t, a.Attempt, i+1)
+		assert.Equal(t, a.Stage, StagePost)
+	}
+	assert.Equal(t, attempts[0].ErrorClass, "other")
+	assert.ErrorContains(t, errors.New(attempts[1].Error), "connection reset")
+	assert.Assert(t, !attempts[2].Failed())
+	posted, err := p.data.GetRecord(ctx, "0-public")
+	assert.NilError(t, err)
+	assert.Equal(t, attempts[2].TargetPostURI, posted.TargetPostID)
+	attempts, err = p.data.ListAttempts(ctx, "2-public")
+	assert.NilError(t, err)
+	assert.Equal(t, len(attempts), 1)
+	assert.Equal(t, attempts[0].ErrorClass, "other")
+}
+
+func TestRecordKeys(t *testing.T) {
+	createdAt := time.Date(2024, 1, 20, 15, 4, 5, 123000000, time.UTC)
+	toots := []mastodon.Status{
+		{Status: gomastodon.Status{ID: "1", Visibility: gomastodon.VisibilityPublic, CreatedAt: createdAt}},
+		// an outbox only has the second a toot was made
+		{Status: gomastodon.Status{ID: "2", Visibility: gomastodon.VisibilityPublic, CreatedAt: createdAt.Truncate(time.Second)}},
+		{Status: gomastodon.Status{ID: "3", Visibility: gomastodon.VisibilityPublic}},
+	}
+	sink := &flakySink{failures: map[string]int{"1": 2}}
+	p := newTestProcessor(t, &openSource{toots: toots}, sink, Config{
+		SourceID: "https://example.com/@me",
+		Retry:    RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Interval: 5 * time.Millisecond},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.Run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.posted()) < len(toots) {
+		if time.Now().After(deadline) {
+			t.Fatalf("only posted %v", sink.posted())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	// every attempt used the same key so a post that wasn't recorded
+	// can't be made twice, and toots from the same second don't share one
+	want1 := bsky.RecordKey(createdAt, "1", clockID("https://example.com/@me"))
+	want2 := bsky.RecordKey(createdAt, "2", clockID("https://example.com/@me"))
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	count := map[string]int{}
+	for _, rkey := range sink.rkeys {
+		assert.Assert(t, rkey != "", "toot without a created time has no key")
+		count[rkey]++
+	}
+	assert.Equal(t, len(sink.rkeys), 5)
+	assert.Equal(t, count[want1], 3)
+	assert.Equal(t, count[want2], 1)
+	assert.Equal(t, len(count), 3)
+	assert.Assert(t, clockID("https://example.com/@me") != clockID("https://example.com/tags/bsky"))
+}
+
+func TestRecordKeyAfterMove(t *testing.T) {
+	toot := mastodon.Status{Status: gomastodon.Status{
+		ID:        "1",
+		CreatedAt: time.Date(2024, 1, 20, 15, 4, 5, 0, time.UTC),
+		Account:   gomastodon.Account{URL: "https://old.example/@me"},
+	}}
+	before := New(nil, nil, nil, Config{SourceID: "https://old.example/@me"})
+	after := New(nil, nil, nil, Config{SourceID: "https://new.example/@me"})
+	// a toot being retried after following the account keeps its key
+	assert.Equal(t, after.recordKey(toot, time.Time{}), before.recordKey(toot, time.Time{}))
+
+	other := toot
+	other.Account.URL = "https://example.com/@other"
+	assert.Assert(t, before.recordKey(other, time.Time{}) != before.recordKey(toot, time.Time{}))
+}
+
+// crashingSink makes posts like bluesky does, and the first time it's
+// posted to it stops the run as if the process was killed before it heard
+// back.  Posting again with the same record key gets the post that's there.
+type crashingSink struct {
+	mu     sync.Mutex
+	crash  context.CancelFunc
+	posts  map[string]*bsky.PostResult
+	rkeys  []string
+	create int
+}
+
+func (s *crashingSink) Post(ctx context.Context, post bsky.Post) (*bsky.PostResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rkeys = append(s.rkeys, post.Rkey)
+	if result, ok := s.posts[post.Rkey]; ok {
+		return result, nil
+	}
+	s.create++
+	result := &bsky.PostResult{
+		Cid:  "cid-" + post.Rkey,
+		Uri:  "at://did:plc:test/app.bsky.feed.post/" + post.Rkey,
+		Rkey: post.Rkey,
+		URL:  bsky.PostURL("test.bsky.social", post.Rkey),
+	}
+	s.posts[post.Rkey] = result
+	if s.crash != nil {
+		s.crash()
+		s.crash = nil
+		return nil, context.Canceled
+	}
+	return result, nil
+}
+
+func TestRecoverInterruptedRun(t *testing.T) {
+	toot := mastodon.Status{Status: gomastodon.Status{
+		ID:         "1",
+		Visibility: gomastodon.VisibilityPublic,
+		CreatedAt:  time.Date(2024, 1, 20, 15, 4, 5, 0, time.UTC),
+	}}
+	ctx, kill := context.WithCancel(context.Background())
+	sink := &crashingSink{crash: kill, posts: map[string]*bsky.PostResult{}}
+	cfg := Config{
+		SourceID: "https://example.com/@me",
+		Retry:    RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Interval: 5 * time.Millisecond},
+	}
+	p := newTestProcessor(t, &openSource{toots: []mastodon.Status{toot}}, sink, cfg)
+	err := p.Run(ctx)
+	assert.Assert(t, errors.Is(err, context.Canceled), err)
+	record, err := p.data.GetRecord(context.Background(), "1")
+	assert.NilError(t, err)
+	assert.Equal(t, record.State, StatePosting)
+	checkpoint, err := p.data.GetCheckpoint(context.Background(), cfg.SourceID)
+	assert.NilError(t, err)
+	assert.Equal(t, checkpoint, "", "checkpoint moved past a toot that wasn't finished")
+
+	// the next run has nothing new from the source but picks the toot up
+	// again, and finds the post that was made instead of making another
+	next := New(p.data, &openSource{}, sink, cfg)
+	next.transform = testTransform
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- next.Run(ctx) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		record, err = p.data.GetRecord(context.Background(), "1")
+		assert.NilError(t, err)
+		if record.State == StatePosted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("interrupted toot is still %s", record.State)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	assert.Equal(t, sink.create, 1)
+	assert.Equal(t, len(sink.rkeys), 2)
+	assert.Equal(t, sink.rkeys[0], sink.rkeys[1])
+	assert.Equal(t, record.TargetPostID, "at://did:plc:test/app.bsky.feed.post/"+sink.rkeys[0])
+	assert.Equal(t, record.Attempts, 2)
+}
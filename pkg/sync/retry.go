@@ -0,0 +1,145 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+	gomastodon "github.com/mattn/go-mastodon"
+	"github.com/willgorman/mastodon-bsky/pkg/mastodon"
+	"github.com/willgorman/mastodon-bsky/pkg/remote"
+)
+
+// RetryPolicy decides when toots that failed to crosspost are tried again
+type RetryPolicy struct {
+	// MaxAttempts is how many times a toot is tried before it's given up
+	// on and moved to StateFailedPermanent
+	MaxAttempts int `mapstructure:"max_attempts"`
+	// BaseDelay is the wait after the first failure, it doubles with
+	// every attempt after that
+	BaseDelay time.Duration `mapstructure:"base_delay"`
+	// MaxDelay caps the wait between attempts
+	MaxDelay time.Duration `mapstructure:"max_delay"`
+	// Interval is how often to look for toots that are due a retry
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   time.Minute,
+	MaxDelay:    6 * time.Hour,
+	Interval:    30 * time.Second,
+}
+
+// withDefaults fills in what isn't set from DefaultRetryPolicy
+func (r RetryPolicy) withDefaults() RetryPolicy {
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if r.BaseDelay <= 0 {
+		r.BaseDelay = DefaultRetryPolicy.BaseDelay
+	}
+	if r.MaxDelay <= 0 {
+		r.MaxDelay = DefaultRetryPolicy.MaxDelay
+	}
+	if r.Interval <= 0 {
+		r.Interval = DefaultRetryPolicy.Interval
+	}
+	return r
+}
+
+// Backoff is how long to wait after the given number of attempts.  It's
+// somewhere between half and all of the exponential delay so toots that
+// failed together don't all retry together.
+func (r RetryPolicy) Backoff(attempts int) time.Duration {
+	delay := r.BaseDelay
+	for i := 1; i < attempts && delay < r.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > r.MaxDelay {
+		delay = r.MaxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// transient reports whether an error could go away if the toot is tried
+// again.  Network errors, rate limits and server errors are transient.
+// Errors that don't say either way are taken to be transient when posting,
+// where MaxAttempts stops them being retried forever, and permanent when
+// converting, where they come from the toot itself.
+func transient(err error, posting bool) bool {
+	// the typed errors of the bsky and mastodon clients know for themselves
+	var terr interface{ Transient() bool }
+	if errors.As(err, &terr) {
+		return terr.Transient()
+	}
+	var xerr *xrpc.Error
+	if errors.As(err, &xerr) {
+		return xerr.StatusCode == http.StatusTooManyRequests ||
+			xerr.StatusCode == http.StatusRequestTimeout ||
+			xerr.StatusCode >= 500
+	}
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		return true
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return true
+	}
+	return posting
+}
+
+// authExpired reports whether the error is a server not taking the
+// credentials, which no toot would get past
+func authExpired(err error) bool {
+	var rerr *remote.Error
+	return errors.As(err, &rerr) && rerr.Kind == remote.AuthExpired
+}
+
+// sourceRecovers reports whether a source carries on after sending the
+// error, so the run can too.  Network errors, rate limits and server errors
+// while polling are tried again by the source.  A moved account, a
+// checkpoint that can't be found or credentials that aren't accepted
+// won't go away.
+func sourceRecovers(err error) bool {
+	var moved *mastodon.MovedError
+	if errors.As(err, &moved) || errors.Is(err, mastodon.ErrCheckpointNotFound) || authExpired(err) {
+		return false
+	}
+	return transient(err, false)
+}
+
+// storedToot is the JSON a toot is kept as for retries.  Status decodes the
+// mastodon API JSON so the fields it adds are kept alongside it.
+type storedToot struct {
+	Status          gomastodon.Status `json:"status"`
+	ApplicationName string            `json:"application_name"`
+	Text            string            `json:"text"`
+}
+
+func storeToot(toot mastodon.Status) (string, error) {
+	data, err := json.Marshal(storedToot{Status: toot.Status, ApplicationName: toot.ApplicationName, Text: toot.Text})
+	if err != nil {
+		return "", fmt.Errorf("could not store toot %s: %w", toot.ID, err)
+	}
+	return string(data), nil
+}
+
+func loadToot(data string) (mastodon.Status, error) {
+	if data == "" {
+		return mastodon.Status{}, errors.New("toot wasn't stored so it can't be retried")
+	}
+	var stored storedToot
+	if err := json.Unmarshal([]byte(data), &stored); err != nil {
+		return mastodon.Status{}, fmt.Errorf("could not load stored toot: %w", err)
+	}
+	return mastodon.Status{Status: stored.Status, ApplicationName: stored.ApplicationName, Text: stored.Text}, nil
+}
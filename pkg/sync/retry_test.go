@@ -0,0 +1,100 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/xrpc"
+	gomastodon "github.com/mattn/go-mastodon"
+	"github.com/willgorman/mastodon-bsky/pkg/mastodon"
+	"github.com/willgorman/mastodon-bsky/pkg/remote"
+	"gotest.tools/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: time.Minute, MaxDelay: 10 * time.Minute}
+	tests := []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{attempts: 1, max: time.Minute},
+		{attempts: 2, max: 2 * time.Minute},
+		{attempts: 3, max: 4 * time.Minute},
+		{attempts: 4, max: 8 * time.Minute},
+		{attempts: 5, max: 10 * time.Minute},
+		{attempts: 50, max: 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.attempts), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				delay := policy.Backoff(tt.attempts)
+				assert.Assert(t, delay >= tt.max/2 && delay <= tt.max, delay)
+			}
+		})
+	}
+}
+
+func TestTransient(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		posting bool
+		want    bool
+	}{
+		{name: "rate limited", err: &xrpc.Error{StatusCode: http.StatusTooManyRequests}, want: true},
+		{name: "server error", err: fmt.Errorf("failed to post: %w", &xrpc.Error{StatusCode: http.StatusBadGateway}), want: true},
+		{name: "invalid record", err: &xrpc.Error{StatusCode: http.StatusBadRequest}, posting: true, want: false},
+		{name: "network", err: &url.Error{Op: "Get", URL: "https://example.com/image.png", Err: errors.New("connection refused")}, want: true},
+		{name: "bsky auth expired", err: fmt.Errorf("failed to post: %w", &remote.Error{Service: "bluesky", Kind: remote.AuthExpired, StatusCode: http.StatusUnauthorized}), posting: true, want: false},
+		{name: "bsky upstream", err: &remote.Error{Service: "bluesky", Kind: remote.Upstream, StatusCode: http.StatusServiceUnavailable}, want: true},
+		{name: "mastodon not found", err: &remote.Error{Service: "mastodon", Kind: remote.NotFound, StatusCode: http.StatusNotFound}, posting: true, want: false},
+		{name: "mastodon rate limited", err: &remote.Error{Service: "mastodon", Kind: remote.RateLimited, StatusCode: http.StatusTooManyRequests}, want: true},
+		{name: "unknown error posting", err: errors.New("oh no"), posting: true, want: true},
+		{name: "unknown error converting", err: errors.New("template is over the limit"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, transient(tt.err, tt.posting), tt.want)
+		})
+	}
+}
+
+func TestSourceRecovers(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "bad gateway", err: &remote.Error{Service: "mastodon", Kind: remote.Upstream, StatusCode: http.StatusBadGateway}, want: true},
+		{name: "network", err: fmt.Errorf("connecting to stream: %w", &remote.Error{Service: "mastodon", Kind: remote.Network, Err: errors.New("connection reset")}), want: true},
+		{name: "auth expired", err: &remote.Error{Service: "mastodon", Kind: remote.AuthExpired, StatusCode: http.StatusUnauthorized}, want: false},
+		{name: "moved", err: &mastodon.MovedError{}, want: false},
+		{name: "checkpoint not found", err: fmt.Errorf("%w: 1", mastodon.ErrCheckpointNotFound), want: false},
+		{name: "list not found", err: &remote.Error{Service: "mastodon", Kind: remote.NotFound, StatusCode: http.StatusNotFound}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, sourceRecovers(tt.err), tt.want)
+		})
+	}
+}
+
+func TestStoredToot(t *testing.T) {
+	toot := mastodon.Status{
+		Status:          gomastodon.Status{ID: "1", Content: "<p>hello</p>", Visibility: "public"},
+		ApplicationName: "Web",
+		Text:            "hello",
+	}
+	stored, err := storeToot(toot)
+	assert.NilError(t, err)
+	loaded, err := loadToot(stored)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, loaded, toot)
+
+	_, err = loadToot("")
+	assert.ErrorContains(t, err, "can't be retried")
+}
@@ -0,0 +1,62 @@
+package sync
+
+import (
+	"errors"
+)
+
+// State is where a sync record is in crossposting its toot
+type State string
+
+const (
+	// StatePending records have been added but not worked on yet
+	StatePending State = "pending"
+	// StateConverting records are having their toot translated to a post.
+	// Every attempt starts here.
+	StateConverting State = "converting"
+	// StatePosting records are being sent to bluesky
+	StatePosting State = "posting"
+	// StatePosted records have been crossposted
+	StatePosted State = "posted"
+	// StateFailedTransient records failed in a way that could work if
+	// they're tried again
+	StateFailedTransient State = "failed-transient"
+	// StateFailedPermanent records won't be tried again, because the error
+	// won't go away or they ran out of attempts.  It's the dead letter
+	// state, see LastError for why.
+	StateFailedPermanent State = "failed-permanent"
+	// StateSkipped records were not crossposted because of the config,
+	// see SkipReason
+	StateSkipped State = "skipped"
+	// StateDeleted records had their toot deleted before it was posted
+	StateDeleted State = "deleted"
+)
+
+// transitions are the states each state can move to
+var transitions = map[State][]State{
+	StatePending:         {StateConverting, StateSkipped, StateDeleted, StateFailedTransient},
+	StateConverting:      {StatePosting, StateFailedTransient, StateFailedPermanent, StateSkipped},
+	StatePosting:         {StatePosted, StateFailedTransient, StateFailedPermanent},
+	StateFailedTransient: {StateConverting, StateFailedPermanent, StateDeleted},
+	StateFailedPermanent: {StateDeleted},
+	StateSkipped:         {StateDeleted},
+	StatePosted:          {},
+	StateDeleted:         {},
+}
+
+// ErrInvalidTransition is returned for a change of state that the state
+// machine doesn't allow
+var ErrInvalidTransition = errors.New("invalid state transition")
+
+// ErrStaleState is returned when a record isn't in the state a transition
+// started from any more, because something else changed it first
+var ErrStaleState = errors.New("record state has changed")
+
+// CanTransition reports whether a record can move from s to the state
+func (s State) CanTransition(to State) bool {
+	for _, next := range transitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
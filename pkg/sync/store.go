@@ -0,0 +1,189 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"runtime"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jmoiron/sqlx"
+)
+
+// Store keeps the sync records and the posts they became, checkpoints,
+// attempt history and the lease on running.  Datastore implements it for
+// SQLite, the default, and Postgres for several instances sharing a
+// database.
+type Store interface {
+	ListRecords(ctx context.Context) ([]SyncRecord, error)
+	GetRecord(ctx context.Context, sourcePostID string) (*SyncRecord, error)
+	CreateRecord(ctx context.Context, record SyncRecord) error
+	Transition(ctx context.Context, record *SyncRecord, to State) error
+	DueRecords(ctx context.Context, now time.Time, limit int) ([]SyncRecord, error)
+	RecoverInterrupted(ctx context.Context, now time.Time) (int64, error)
+
+	GetCheckpoint(ctx context.Context, source string) (string, error)
+	SetCheckpoint(ctx context.Context, source, statusID string) error
+	MoveCheckpoint(ctx context.Context, from, to string) error
+
+	SetTargets(ctx context.Context, sourcePostID string, targets []Target) error
+	ListTargets(ctx context.Context, sourcePostID string) ([]Target, error)
+
+	AddAttempt(ctx context.Context, attempt Attempt) error
+	ListAttempts(ctx context.Context, sourcePostID string) ([]Attempt, error)
+	FailedAttempts(ctx context.Context, since time.Time, limit int) ([]Attempt, error)
+
+	AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) error
+	RenewLease(ctx context.Context, name, holder string, ttl time.Duration) error
+	ReleaseLease(ctx context.Context, name, holder string) error
+
+	Close() error
+}
+
+var _ Store = (*Datastore)(nil)
+
+// dialect is what differs between the databases a Datastore can use
+type dialect struct {
+	driver string
+	// dsn turns a data path into the connection string for writing
+	dsn func(dataPath string) string
+	// readDSN is the connection string for a separate pool of readers, or
+	// nil if reads share the writers' pool
+	readDSN func(dataPath string) string
+	// writers limits the connections that write, or 0 for no limit
+	writers int
+	// timestamp is the column type for times
+	timestamp string
+	// migrations is the directory of migrations for the database
+	migrations string
+	// tables lists the tables in the database
+	tables string
+	// nonNumeric is a condition that the column isn't all digits
+	nonNumeric func(column string) string
+	// now is the time by the database's clock, which every instance
+	// shares even if the clocks of their hosts don't agree
+	now string
+	// later is the time by the database's clock a placeholder's number of
+	// seconds from now
+	later string
+	// lock is run at the start of migrating so only one instance migrates
+	// at a time
+	lock string
+	// legacy databases were made before schema_version, see adoptLegacy
+	legacy bool
+}
+
+// SQLite only has one writer at a time, so rather than connections
+// taking turns with SQLITE_BUSY there's one connection that writes and a
+// pool of readers, which WAL lets read while it writes
+var sqliteDialect = dialect{
+	driver:     "sqlite",
+	dsn:        sqliteDSN,
+	readDSN:    sqliteReadDSN,
+	writers:    1,
+	timestamp:  "DATETIME",
+	migrations: "migrations/sqlite",
+	tables:     `SELECT name FROM sqlite_master WHERE type = 'table'`,
+	nonNumeric: func(column string) string { return column + ` GLOB '*[^0-9]*'` },
+	now:        `strftime('%Y-%m-%d %H:%M:%f', 'now')`,
+	later:      `strftime('%Y-%m-%d %H:%M:%f', 'now', ? || ' seconds')`,
+	legacy:     true,
+}
+
+var postgresDialect = dialect{
+	driver:     "pgx",
+	dsn:        func(url string) string { return url },
+	timestamp:  "TIMESTAMPTZ",
+	migrations: "migrations/postgres",
+	tables:     `SELECT table_name::text FROM information_schema.tables WHERE table_schema = current_schema()`,
+	nonNumeric: func(column string) string { return column + ` ~ '[^0-9]'` },
+	now:        `CURRENT_TIMESTAMP`,
+	later:      `CURRENT_TIMESTAMP + make_interval(secs => ?)`,
+	// the key is arbitrary, it only has to be the same for every instance
+	lock: `SELECT pg_advisory_xact_lock(7126415503)`,
+}
+
+// isPostgres reports whether a data_path is a Postgres connection URL
+// instead of a SQLite file
+func isPostgres(dataPath string) bool {
+	return strings.HasPrefix(dataPath, "postgres://") || strings.HasPrefix(dataPath, "postgresql://")
+}
+
+// Open opens the Postgres database for a postgres:// URL, or the SQLite
+// database at any other path, and applies any migrations it doesn't have
+// yet
+func Open(dataPath string) (*Datastore, error) {
+	if isPostgres(dataPath) {
+		return OpenPostgres(dataPath)
+	}
+	return OpenDatastore(dataPath)
+}
+
+// OpenPostgres opens the Postgres database at the connection URL and
+// applies any migrations it doesn't have yet
+func OpenPostgres(url string) (*Datastore, error) {
+	return open(postgresDialect, url)
+}
+
+func open(dialect dialect, dataPath string) (*Datastore, error) {
+	d, err := connect(dialect, dataPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Migrate(context.Background()); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("failed to migrate: %w", err)
+	}
+	return d, nil
+}
+
+// connect opens the database without migrating it
+func connect(dialect dialect, dataPath string) (*Datastore, error) {
+	db, err := connectPool(dialect, dialect.dsn(dataPath), dialect.writers)
+	if err != nil {
+		return nil, err
+	}
+	read := db
+	if dialect.readDSN != nil {
+		// the writer goes first so the database is in WAL mode before
+		// anything reads it
+		read, err = connectPool(dialect, dialect.readDSN(dataPath), runtime.NumCPU())
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &Datastore{db: db, read: read, dialect: dialect}, nil
+}
+
+func connectPool(dialect dialect, dsn string, conns int) (*sqlx.DB, error) {
+	db, err := sqlx.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s database: %w", dialect.driver, err)
+	}
+	if conns > 0 {
+		db.SetMaxOpenConns(conns)
+		db.SetMaxIdleConns(conns)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to %s database: %w", dialect.driver, err)
+	}
+	return db, nil
+}
+
+func (d *Datastore) Close() error {
+	err := d.db.Close()
+	if d.read != d.db {
+		if rerr := d.read.Close(); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+func (d dialect) migrationFiles() (fs.FS, error) {
+	return fs.Sub(migrationFiles, d.migrations)
+}
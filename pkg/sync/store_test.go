@@ -0,0 +1,143 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"gotest.tools/assert"
+)
+
+// storeTests are what every Store has to do
+var storeTests = []struct {
+	name string
+	test func(t *testing.T, ds Store)
+}{
+	{"Checkpoint", testCheckpoint},
+	{"MoveCheckpoint", testMoveCheckpoint},
+	{"Transition", testTransition},
+	{"TransitionOnlyUpdatesItsRow", testTransitionOnlyUpdatesItsRow},
+	{"ConcurrentTransitions", testConcurrentTransitions},
+	{"RecoverInterrupted", testRecoverInterrupted},
+	{"Attempts", testAttempts},
+	{"Lease", testLease},
+	{"Targets", testTargets},
+}
+
+func TestSQLiteStore(t *testing.T) {
+	for _, tt := range storeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds, err := CreateDatastore(fmt.Sprintf("%s/sync.db", t.TempDir()))
+			assert.NilError(t, err)
+			t.Cleanup(func() { ds.Close() })
+			tt.test(t, ds)
+		})
+	}
+}
+
+func TestPostgresStore(t *testing.T) {
+	server := postgresServer(t)
+	for i, tt := range storeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			ds, err := OpenPostgres(postgresSchema(t, server, fmt.Sprintf("store_test_%d", i)))
+			assert.NilError(t, err)
+			t.Cleanup(func() { ds.Close() })
+			tt.test(t, ds)
+		})
+	}
+}
+
+func TestPostgresMigrations(t *testing.T) {
+	server := postgresServer(t)
+	migrations, err := loadMigrations(postgresDialect)
+	assert.NilError(t, err)
+	sqlite, err := loadMigrations(sqliteDialect)
+	assert.NilError(t, err)
+	assert.Equal(t, len(migrations), len(sqlite), "both databases need the same migrations")
+
+	dataPath := postgresSchema(t, server, "migrations_test")
+	ds, err := Open(dataPath)
+	assert.NilError(t, err)
+	ds.Close()
+	// the second instance to open it has nothing to do
+	ds, err = Open(dataPath)
+	assert.NilError(t, err)
+	defer ds.Close()
+	status, err := SchemaStatus(context.Background(), dataPath)
+	assert.NilError(t, err)
+	for _, s := range status {
+		assert.Assert(t, s.AppliedAt.Valid, "migration %d wasn't applied", s.Version)
+	}
+}
+
+// postgresServer is the URL of a Postgres server for the tests, from
+// MASTODON_BSKY_TEST_POSTGRES or one started with initdb and pg_ctl from
+// the PATH.  The test is skipped if there isn't either.
+func postgresServer(t *testing.T) string {
+	t.Helper()
+	if url := os.Getenv("MASTODON_BSKY_TEST_POSTGRES"); url != "" {
+		return url
+	}
+	initdb, err := exec.LookPath("initdb")
+	if err != nil {
+		t.Skip("set MASTODON_BSKY_TEST_POSTGRES or put initdb and pg_ctl on the PATH to test postgres")
+	}
+	pgCtl, err := exec.LookPath("pg_ctl")
+	if err != nil {
+		t.Skip("set MASTODON_BSKY_TEST_POSTGRES or put initdb and pg_ctl on the PATH to test postgres")
+	}
+
+	dir := t.TempDir()
+	data := filepath.Join(dir, "data")
+	if out, err := exec.Command(initdb, "-D", data, "-U", "postgres", "--auth=trust").CombinedOutput(); err != nil {
+		t.Fatalf("initdb: %s\n%s", err, out)
+	}
+	port := freePort(t)
+	options := fmt.Sprintf("-p %d -k %s -c listen_addresses=''", port, dir)
+	if out, err := exec.Command(pgCtl, "-D", data, "-o", options, "-w", "start").CombinedOutput(); err != nil {
+		t.Fatalf("pg_ctl start: %s\n%s", err, out)
+	}
+	t.Cleanup(func() {
+		exec.Command(pgCtl, "-D", data, "-m", "immediate", "stop").Run()
+	})
+	return fmt.Sprintf("postgres://postgres@/postgres?host=%s&port=%d", url.QueryEscape(dir), port)
+}
+
+// postgresSchema makes an empty schema on the server for a test and
+// returns the URL for using it
+func postgresSchema(t *testing.T, server, schema string) string {
+	t.Helper()
+	db, err := sqlx.Open("pgx", server)
+	assert.NilError(t, err)
+	defer db.Close()
+	_, err = db.Exec(fmt.Sprintf(`DROP SCHEMA IF EXISTS %[1]s CASCADE; CREATE SCHEMA %[1]s`, schema))
+	assert.NilError(t, err)
+	t.Cleanup(func() {
+		db, err := sqlx.Open("pgx", server)
+		if err != nil {
+			return
+		}
+		defer db.Close()
+		db.Exec(fmt.Sprintf(`DROP SCHEMA IF EXISTS %s CASCADE`, schema))
+	})
+	u, err := url.Parse(server)
+	assert.NilError(t, err)
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
@@ -0,0 +1,81 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// Role is what a bluesky record is to the toot it came from
+type Role string
+
+const (
+	// RoleRoot is the post a toot became, or the first post of a thread
+	// it was split into
+	RoleRoot Role = "root"
+	// RoleChunk is a later post of a thread a long toot or a toot with
+	// more images than fit in one post was split into
+	RoleChunk Role = "chunk"
+	// RoleRepost is a repost of another post that a boost became
+	RoleRepost Role = "repost"
+)
+
+// Target is one of the bluesky records a toot was crossposted as
+type Target struct {
+	SourcePostID string `db:"source_post_id"`
+	// Position orders the targets of a toot, from 0
+	Position int    `db:"position"`
+	Role     Role   `db:"role"`
+	URI      string `db:"uri"`
+	CID      string `db:"cid"`
+	Rkey     string `db:"rkey"`
+}
+
+// SetTargets saves the records a toot was crossposted as, in order,
+// replacing any it had before
+func (d *Datastore) SetTargets(ctx context.Context, sourcePostID string, targets []Target) error {
+	tx, err := d.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to set targets of %s: %w", sourcePostID, err)
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, tx.Rebind(`DELETE FROM sync_target WHERE source_post_id = ?`), sourcePostID)
+	if err != nil {
+		return fmt.Errorf("unable to set targets of %s: %w", sourcePostID, err)
+	}
+	for i, target := range targets {
+		target.SourcePostID = sourcePostID
+		target.Position = i
+		if target.Rkey == "" {
+			target.Rkey = rkey(target.URI)
+		}
+		_, err := tx.NamedExecContext(ctx,
+			`INSERT INTO sync_target (source_post_id, position, role, uri, cid, rkey)
+				VALUES (:source_post_id, :position, :role, :uri, :cid, :rkey)`, &target)
+		if err != nil {
+			return fmt.Errorf("unable to set targets of %s: %w", sourcePostID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// ListTargets returns the records a toot was crossposted as, in order
+func (d *Datastore) ListTargets(ctx context.Context, sourcePostID string) ([]Target, error) {
+	var targets []Target
+	err := d.read.SelectContext(ctx, &targets,
+		d.read.Rebind(`SELECT * FROM sync_target WHERE source_post_id = ? ORDER BY position`), sourcePostID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query targets: %w", err)
+	}
+	return targets, nil
+}
+
+// rkey is the record key of an at-uri, or "" if it isn't one
+func rkey(uri string) string {
+	aturi, err := syntax.ParseATURI(uri)
+	if err != nil {
+		return ""
+	}
+	return aturi.RecordKey().String()
+}
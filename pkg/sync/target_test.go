@@ -0,0 +1,43 @@
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func testTargets(t *testing.T, ds Store) {
+	ctx := context.Background()
+
+	targets, err := ds.ListTargets(ctx, "a")
+	assert.NilError(t, err)
+	assert.Equal(t, len(targets), 0)
+
+	// a toot split into a thread
+	thread := []Target{
+		{Role: RoleRoot, URI: "at://did:plc:me/app.bsky.feed.post/3kroot", CID: "cid1"},
+		{Role: RoleChunk, URI: "at://did:plc:me/app.bsky.feed.post/3kchunk", CID: "cid2"},
+		{Role: RoleChunk, URI: "at://did:plc:me/app.bsky.feed.post/3kother", CID: "cid3", Rkey: "given"},
+	}
+	assert.NilError(t, ds.SetTargets(ctx, "a", thread))
+	assert.NilError(t, ds.SetTargets(ctx, "b", thread[:1]))
+	targets, err = ds.ListTargets(ctx, "a")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, targets, []Target{
+		{SourcePostID: "a", Position: 0, Role: RoleRoot, URI: "at://did:plc:me/app.bsky.feed.post/3kroot", CID: "cid1", Rkey: "3kroot"},
+		{SourcePostID: "a", Position: 1, Role: RoleChunk, URI: "at://did:plc:me/app.bsky.feed.post/3kchunk", CID: "cid2", Rkey: "3kchunk"},
+		{SourcePostID: "a", Position: 2, Role: RoleChunk, URI: "at://did:plc:me/app.bsky.feed.post/3kother", CID: "cid3", Rkey: "given"},
+	})
+
+	// setting them again replaces them
+	assert.NilError(t, ds.SetTargets(ctx, "a", []Target{{Role: RoleRepost, URI: "at://did:plc:me/app.bsky.feed.repost/3krepost"}}))
+	targets, err = ds.ListTargets(ctx, "a")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, targets, []Target{
+		{SourcePostID: "a", Role: RoleRepost, URI: "at://did:plc:me/app.bsky.feed.repost/3krepost", Rkey: "3krepost"},
+	})
+	targets, err = ds.ListTargets(ctx, "b")
+	assert.NilError(t, err)
+	assert.Equal(t, len(targets), 1)
+}
@@ -0,0 +1,15 @@
+-- a database made by the first version, before schema_version
+CREATE TABLE IF NOT EXISTS sync_record (
+	source_post_id TEXT PRIMARY KEY,
+	source_post_url TEXT,
+	target_post_id TEXT,
+	target_post_url TEXT,
+	added_at DATETIME NOT NULL,
+	synced_at DATETIME NULL,
+	attempts INT DEFAULT 0 NOT NULL,
+	last_error TEXT DEFAULT "" NOT NULL
+);
+INSERT INTO sync_record (source_post_id, source_post_url, target_post_id, target_post_url, added_at, synced_at, attempts, last_error) VALUES
+	('posted', 'https://example.com/1', 'bafyreicid', 'at://did:plc:me/app.bsky.feed.post/3kj2tj5zmqc2x', '2024-01-20 12:00:00', '2024-01-20 12:00:01', 1, ''),
+	('failed', 'https://example.com/2', '', '', '2024-01-20 12:00:00', NULL, 1, 'oh no'),
+	('pending', 'https://example.com/3', '', '', '2024-01-20 12:00:00', NULL, 0, '');
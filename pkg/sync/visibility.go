@@ -0,0 +1,54 @@
+package sync
+
+import (
+	"fmt"
+
+	gomastodon "github.com/mattn/go-mastodon"
+)
+
+// VisibilityPolicy is the set of mastodon visibilities that are allowed
+// to be crossposted.  An empty policy allows only public toots.
+type VisibilityPolicy []string
+
+var DefaultVisibilityPolicy = VisibilityPolicy{gomastodon.VisibilityPublic}
+
+// ParseVisibilityPolicy validates a list of visibilities from config.
+// Direct messages can never be crossposted so asking for them is an error
+// rather than something that gets silently dropped.
+func ParseVisibilityPolicy(visibilities []string) (VisibilityPolicy, error) {
+	if len(visibilities) == 0 {
+		return DefaultVisibilityPolicy, nil
+	}
+	policy := VisibilityPolicy{}
+	for _, v := range visibilities {
+		switch v {
+		case gomastodon.VisibilityPublic, gomastodon.VisibilityUnlisted, gomastodon.VisibilityFollowersOnly:
+			policy = append(policy, v)
+		case gomastodon.VisibilityDirectMessage:
+			return nil, fmt.Errorf("visibility %q can not be crossposted", v)
+		default:
+			return nil, fmt.Errorf("unknown visibility %q", v)
+		}
+	}
+	return policy, nil
+}
+
+// Allows reports whether a toot with the given visibility may be posted.
+// Direct messages and unknown visibilities are always refused, no matter
+// what the policy contains.
+func (v VisibilityPolicy) Allows(visibility string) bool {
+	switch visibility {
+	case gomastodon.VisibilityPublic, gomastodon.VisibilityUnlisted, gomastodon.VisibilityFollowersOnly:
+	default:
+		return false
+	}
+	if len(v) == 0 {
+		v = DefaultVisibilityPolicy
+	}
+	for _, allowed := range v {
+		if allowed == visibility {
+			return true
+		}
+	}
+	return false
+}